@@ -9,7 +9,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -59,26 +64,62 @@ func reArrange(agentFiles []AgentFiles) []AgentFiles {
 	return out
 }
 
-// helper function to find LFNs within in agent list
-func findFiles(agents map[string]string, src string) ([]AgentFiles, error) {
-
-	// parse the input
+// helper function to parse source into lfn, block and dataset names
+func parseSrc(src string) (string, string, string) {
 	var lfn, block, dataset string
 	if strings.Contains(src, "#") { // it is a block name, e.g. /a/b/c#123
 		arr := strings.Split(src, "#")
 		dataset = arr[0]
-		block = arr[1]
+		block = src
 	} else if strings.Count(src, "/") == 3 { // it is a dataset
 		dataset = src
 	} else { // it is lfn
 		lfn = src
 	}
+	return lfn, block, dataset
+}
+
+// helper function to select agents which hold replicas of given block or
+// dataset according to replica index of given agent, all agents are returned
+// for LFNs and if index does not know any replica
+func replicaAgents(agent string, agents map[string]string, block, dataset string) map[string]string {
+	if block == "" && dataset == "" {
+		return agents
+	}
+	rurl := fmt.Sprintf("%s/replicas?block=%s&dataset=%s", agent, url.QueryEscape(block), url.QueryEscape(dataset))
+	resp := utils.FetchResponse(rurl, []byte{})
+	if resp.Error != nil || resp.StatusCode != http.StatusOK {
+		return agents
+	}
+	var replicas []core.Replica
+	if err := json.Unmarshal(resp.Data, &replicas); err != nil || len(replicas) == 0 {
+		return agents
+	}
+	out := make(map[string]string)
+	for _, r := range replicas {
+		if aurl, ok := agents[r.Agent]; ok {
+			out[r.Agent] = aurl
+		}
+	}
+	if len(out) == 0 {
+		return agents
+	}
+	return out
+}
+
+// helper function to find LFNs within in agent list, agents are looked up in
+// replica index of given agent to avoid query of every agent
+func findFiles(agent string, agents map[string]string, src string) ([]AgentFiles, error) {
+
+	// parse the input
+	lfn, block, dataset := parseSrc(src)
+	agents = replicaAgents(agent, agents, block, dataset)
 
 	out := make(chan utils.ResponseType)
 	defer close(out)
 	umap := map[string]int{}
 	for _, aurl := range agents {
-		furl := fmt.Sprintf("%s/files?lfn=%s&block=%s&dataset=%s", aurl, lfn, block, dataset)
+		furl := fmt.Sprintf("%s/files?lfn=%s&block=%s&dataset=%s", aurl, url.QueryEscape(lfn), url.QueryEscape(block), url.QueryEscape(dataset))
 		umap[furl] = 1 // keep track of processed urls below
 		go utils.Fetch(furl, []byte{}, out)
 	}
@@ -112,8 +153,33 @@ func findFiles(agents map[string]string, src string) ([]AgentFiles, error) {
 	return reArrange(agentFiles), nil
 }
 
+// helper function to resolve transfer mode, if it is not given we use the
+// mode of destination agent
+func transferMode(dstUrl, mode string) (string, error) {
+	if mode == "" {
+		url := fmt.Sprintf("%s/status", dstUrl)
+		resp := utils.FetchResponse(url, []byte{})
+		if resp.Error != nil {
+			return mode, resp.Error
+		}
+		var dstAgent core.AgentStatus
+		err := json.Unmarshal(resp.Data, &dstAgent)
+		if err != nil {
+			return mode, err
+		}
+		mode = dstAgent.Mode
+	}
+	switch mode {
+	case "", core.PushMode:
+		return core.PushMode, nil
+	case core.PullMode:
+		return core.PullMode, nil
+	}
+	return mode, fmt.Errorf("Unknown transfer mode %s", mode)
+}
+
 // helper function to parse source and destination parameters
-func parse(agent, src, dst string) ([][]core.TransferRequest, error) {
+func parse(agent, src, dst, mode string, priority int) ([][]core.TransferRequest, error) {
 	var tr [][]core.TransferRequest
 	var dstUrl string
 
@@ -144,17 +210,30 @@ func parse(agent, src, dst string) ([][]core.TransferRequest, error) {
 		}).Error("Unable to resolve destination")
 		return tr, fmt.Errorf("Unknown destination")
 	}
+	mode, err := transferMode(dstUrl, mode)
+	if err != nil {
+		return tr, err
+	}
 
 	// get list of records which provide info about agent and a file
 	// and construct transfer collection
-	records, err := findFiles(remoteAgents, src) // src here can be either lfn/block/dataset
+	records, err := findFiles(agent, remoteAgents, src) // src here can be either lfn/block/dataset
 	if err != nil {
 		return tr, err
 	}
+	lfn, block, dataset := parseSrc(src)
 	for _, rec := range records {
 		var requests []core.TransferRequest
+		if lfn == "" {
+			// block or dataset is transferred as a single request, the source
+			// agent will ship its files in bulk
+			req := core.TransferRequest{SrcUrl: rec.Url, SrcAlias: rec.Alias, Block: block, Dataset: dataset, DstUrl: dstUrl, DstAlias: dst, Priority: priority, Mode: mode}
+			log.Println(req.String())
+			tr = append(tr, []core.TransferRequest{req})
+			continue
+		}
 		for _, file := range rec.Files {
-			req := core.TransferRequest{SrcUrl: rec.Url, SrcAlias: rec.Alias, File: file, DstUrl: dstUrl, DstAlias: dst}
+			req := core.TransferRequest{SrcUrl: rec.Url, SrcAlias: rec.Alias, File: file, DstUrl: dstUrl, DstAlias: dst, Priority: priority, Mode: mode}
 			log.Println(req.String())
 			requests = append(requests, req)
 		}
@@ -164,11 +243,12 @@ func parse(agent, src, dst string) ([][]core.TransferRequest, error) {
 }
 
 // Transfer client function is responsible to initiate transfer request from
-// source to destination.
-func Transfer(agent, src, dst string) error {
+// source to destination with given mode and priority. Requests are sent to
+// source agent in push mode and to destination agent in pull mode.
+func Transfer(agent, src, dst, mode string, priority int) error {
 
 	// parse src/dst parameters and construct list of transfer requests
-	collection, err := parse(agent, src, dst)
+	collection, err := parse(agent, src, dst, mode, priority)
 	if err != nil {
 		return err
 	}
@@ -176,9 +256,19 @@ func Transfer(agent, src, dst string) error {
 	// send tranfer requests to agents concurrently via go-routine
 	out := make(chan utils.ResponseType)
 	defer close(out)
-	umap := map[string]int{}
+	// requests are processed by source agents in push mode and by destination
+	// agent in pull mode, merge requests of the same agent
+	agentRequests := make(map[string][]core.TransferRequest)
 	for _, transferRequests := range collection {
-		furl := fmt.Sprintf("%s/request", transferRequests[0].SrcUrl)
+		aurl := transferRequests[0].SrcUrl
+		if transferRequests[0].Mode == core.PullMode {
+			aurl = transferRequests[0].DstUrl
+		}
+		furl := fmt.Sprintf("%s/request", aurl)
+		agentRequests[furl] = append(agentRequests[furl], transferRequests...)
+	}
+	umap := map[string]int{}
+	for furl, transferRequests := range agentRequests {
 		d, e := json.Marshal(transferRequests)
 		if e != nil {
 			return e
@@ -198,6 +288,19 @@ func Transfer(agent, src, dst string) error {
 				}).Error("ERROR fail with transfer request to", r.Url)
 				return r.Error
 			}
+			if r.StatusCode != http.StatusOK {
+				return fmt.Errorf("transfer request to %s is rejected, %s %s", r.Url, r.Status, strings.TrimSpace(string(r.Data)))
+			}
+			var accepted []core.TransferRequest
+			if err := json.Unmarshal(r.Data, &accepted); err == nil {
+				for _, t := range accepted {
+					log.WithFields(log.Fields{
+						"Id":   t.Id,
+						"File": t.File,
+						"Url":  r.Url,
+					}).Info("Accepted transfer request")
+				}
+			}
 			delete(umap, r.Url) // remove Url from map
 		default:
 			if len(umap) == 0 { // no more requests, merge data records
@@ -220,46 +323,238 @@ func Agent(agent string) error {
 	return resp.Error
 }
 
-// Register function upload given meta-data to the agent and register them in its TFC
-func Register(agent, fname string) error {
+// helper function to construct catalog entry of given record, file checksums
+// are computed with given algorithms unless we trust hash and size of the record
+func registerRecord(rec core.CatalogEntry, checksums []string, trust bool) (core.CatalogEntry, error) {
+	r := core.CatalogEntry{Lfn: rec.Lfn, Pfn: rec.Pfn, Block: rec.Block, Dataset: rec.Dataset}
+	if trust && rec.Hash != "" && rec.Bytes > 0 {
+		r.Bytes = rec.Bytes
+		r.Hash = rec.Hash
+		r.HashType = rec.HashAlgorithm()
+		r.Checksums = rec.AllChecksums()
+		return r, nil
+	}
+	file, err := os.Open(rec.Pfn)
+	if err != nil {
+		return r, err
+	}
+	defer file.Close()
+	sums, bytes, err := utils.Checksums(file, checksums...)
+	if err != nil {
+		return r, err
+	}
+	r.Bytes = bytes
+	r.HashType = checksums[0]
+	r.SetChecksums(sums)
+	return r, nil
+}
+
+// BatchSize defines max number of records registered in agent TFC within single request
+var BatchSize = 1000
+
+// registerProgress keeps track of hashed files during registration
+type registerProgress struct {
+	sync.Mutex
+	Files int64 // number of processed files
+	Bytes int64 // number of processed bytes
+	Total int   // total number of files
+}
+
+// helper function to compute checksums of given records concurrently by
+// given number of workers
+func hashRecords(records []core.CatalogEntry, checksums []string, workers int, trust bool, progress *registerProgress) ([]core.CatalogEntry, error) {
+	// TODO: so far we scan every record and read a file to get its hash
+	// this work only for local filesystem, but I don't know how it will work
+	// for remote storage
+	out := make([]core.CatalogEntry, len(records))
+	var firstErr error
+	var wg sync.WaitGroup
+	indexes := make(chan int)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range indexes {
+				progress.Lock()
+				failed := firstErr != nil
+				progress.Unlock()
+				if failed {
+					continue // drain remaining records
+				}
+				r, err := registerRecord(records[idx], checksums, trust)
+				progress.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = err
+				}
+				out[idx] = r
+				progress.Files++
+				progress.Bytes += r.Bytes
+				progress.Unlock()
+			}
+		}()
+	}
+	for idx := range records {
+		indexes <- idx
+	}
+	close(indexes)
+	wg.Wait()
+	return out, firstErr
+}
+
+// helper function to add given records to agent TFC
+func postRecords(agent string, records []core.CatalogEntry) error {
+	d, e := json.Marshal(records)
+	if e != nil {
+		return e
+	}
+	url := fmt.Sprintf("%s/tfc", agent)
+	resp := utils.FetchResponse(url, d)
+	if resp.Error != nil {
+		return fmt.Errorf("Unable to upload, url=%s, data=%s, err=%v\n", url, string(resp.Data), resp.Error)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unable to register records, url=%s, status=%s, data=%s\n", url, resp.Status, string(resp.Data))
+	}
+	return nil
+}
+
+// helper function to register given records in agent TFC, records are
+// hashed and uploaded in batches of BatchSize records
+func registerRecords(agent string, records []core.CatalogEntry, checksums []string, workers int, trust bool) error {
+	if len(checksums) == 0 {
+		checksums = []string{utils.DefaultChecksum}
+	}
+	for _, alg := range checksums {
+		if _, err := utils.NewHasher(alg); err != nil {
+			return err
+		}
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	batch := BatchSize
+	if batch < 1 {
+		batch = len(records)
+	}
+
+	// report progress of hashing while workers are busy
+	progress := &registerProgress{Total: len(records)}
+	stop := make(chan bool)
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(5 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				progress.Lock()
+				log.WithFields(log.Fields{
+					"Files": fmt.Sprintf("%d/%d", progress.Files, progress.Total),
+					"Bytes": progress.Bytes,
+				}).Info("Registration progress")
+				progress.Unlock()
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < len(records); i += batch {
+		end := i + batch
+		if end > len(records) {
+			end = len(records)
+		}
+		uploadRecords, err := hashRecords(records[i:end], checksums, workers, trust, progress)
+		if err != nil {
+			return err
+		}
+		if err := postRecords(agent, uploadRecords); err != nil {
+			return err
+		}
+		progress.Lock()
+		log.WithFields(log.Fields{
+			"Agent": agent,
+			"Size":  len(uploadRecords),
+			"Files": fmt.Sprintf("%d/%d", progress.Files, progress.Total),
+			"Bytes": progress.Bytes,
+		}).Info("Registered records in")
+		progress.Unlock()
+	}
+	return nil
+}
+
+// Register function upload given meta-data to the agent and register them in its TFC,
+// file checksums are computed with given algorithms, the first one is used as file hash.
+// Files are hashed concurrently by given number of workers, hash and size of
+// records provided in meta-data are used as is if trust flag is set.
+func Register(agent, fname string, checksums []string, workers int, trust bool) error {
 	// read inpuf file name which contains records meta-data (catalog entries)
 	c, e := ioutil.ReadFile(fname)
 	if e != nil {
 		return fmt.Errorf("Unable to read %s, error=%v\n", fname, e)
 	}
-	var uploadRecords, records []core.CatalogEntry
+	var records []core.CatalogEntry
 	err := json.Unmarshal([]byte(c), &records)
 	if err != nil {
 		return fmt.Errorf("Unable to parse catalog JSON file, %v\n", err)
 	}
-	// TODO: so far we scan every record and read a file to get its hash
-	// this work only for local filesystem, but I don't know how it will work
-	// for remote storage
 	for _, rec := range records {
 		if rec.Lfn == "" || rec.Pfn == "" || rec.Block == "" || rec.Dataset == "" {
 			e := fmt.Errorf("Record must have at least the following fields: lfn, pfn, block, dataset, instead received: %v\n", rec)
 			return e
 		}
-		data, err := ioutil.ReadFile(rec.Pfn)
-		if err != nil {
+	}
+	return registerRecords(agent, records, checksums, workers, trust)
+}
+
+// Import function reads catalog entries exported by /tfc/export API from given
+// file and adds them to agent TFC in batches of BatchSize records. Entries keep
+// their dataset and block names, file sizes and checksums. Format of the file
+// is CSV if it has .csv extension and JSON lines otherwise.
+func Import(agent, fname string) error {
+	file, err := os.Open(fname)
+	if err != nil {
+		return fmt.Errorf("Unable to read %s, error=%v\n", fname, err)
+	}
+	defer file.Close()
+	format := core.ExportJSON
+	if strings.ToLower(filepath.Ext(fname)) == ".csv" {
+		format = core.ExportCSV
+	}
+	batch := BatchSize
+	if batch < 1 {
+		batch = 1000
+	}
+	var records []core.CatalogEntry
+	total := 0
+	upload := func() error {
+		if len(records) == 0 {
+			return nil
+		}
+		if err := postRecords(agent, records); err != nil {
 			return err
 		}
-		hash, bytes := utils.Hash(data)
-		r := core.CatalogEntry{Lfn: rec.Lfn, Pfn: rec.Pfn, Block: rec.Block, Dataset: rec.Dataset, Hash: hash, Bytes: bytes}
-		uploadRecords = append(uploadRecords, r)
-	}
-	d, e := json.Marshal(uploadRecords)
-	if e != nil {
-		return e
+		total += len(records)
+		log.WithFields(log.Fields{
+			"Agent": agent,
+			"Size":  len(records),
+			"Files": total,
+		}).Info("Imported records in")
+		records = records[:0]
+		return nil
 	}
-	url := fmt.Sprintf("%s/tfc", agent)
-	resp := utils.FetchResponse(url, d)
-	if resp.Error != nil {
-		return fmt.Errorf("Unable to upload, url=%s, data=%s, err=%v\n", url, string(resp.Data), resp.Error)
+	err = core.ReadEntries(file, format, func(rec core.CatalogEntry) error {
+		if err := rec.Validate(); err != nil {
+			return err
+		}
+		records = append(records, rec)
+		if len(records) < batch {
+			return nil
+		}
+		return upload()
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to import %s, %v\n", fname, err)
 	}
-	log.WithFields(log.Fields{
-		"Agent": agent,
-		"Size":  len(uploadRecords),
-	}).Info("Registered records in")
-	return nil
+	return upload()
 }
@@ -0,0 +1,198 @@
+package client
+
+// transfer2go/client - registration of files found in local directory tree
+//
+// Copyright (c) 2017 - Valentin Kuznetsov <vkuznet@gmail.com>
+//
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vkuznet/transfer2go/core"
+)
+
+// ScanRule defines how LFN, dataset and block names are derived from path of
+// a file relative to scanned directory. Pattern is a regular expression over
+// relative path, files which do not match it are skipped. Lfn, Dataset and
+// Block are templates which can refer to named groups of the pattern, e.g.
+// {{.run}}, to Path, Dir, Base, Name and Ext of relative path and to Root,
+// the name of scanned directory. Lfn and Block templates can also refer to
+// Dataset.
+type ScanRule struct {
+	Pattern string `json:"pattern"` // regular expression over relative path
+	Lfn     string `json:"lfn"`     // LFN template, default /{{.Path}}
+	Dataset string `json:"dataset"` // dataset template, e.g. /a/{{.run}}/raw, default /{{.Root}}
+	Block   string `json:"block"`   // block template, default {{.Dataset}}#{{.Dir}}
+}
+
+// String provides string representation of ScanRule
+func (r *ScanRule) String() string {
+	return fmt.Sprintf("<ScanRule pattern=%s lfn=%s dataset=%s block=%s>", r.Pattern, r.Lfn, r.Dataset, r.Block)
+}
+
+// compiled scan rule
+type scanner struct {
+	root    string
+	pattern *regexp.Regexp
+	lfn     *template.Template
+	dataset *template.Template
+	block   *template.Template
+}
+
+// helper function to compile scan rule
+func (r *ScanRule) compile() (*scanner, error) {
+	var err error
+	s := &scanner{}
+	if r.Dataset == "" {
+		r.Dataset = "/{{.Root}}"
+	}
+	if r.Lfn == "" {
+		r.Lfn = "/{{.Path}}"
+	}
+	if r.Block == "" {
+		r.Block = "{{.Dataset}}#{{.Dir}}"
+	}
+	if r.Pattern != "" {
+		if s.pattern, err = regexp.Compile(r.Pattern); err != nil {
+			return nil, err
+		}
+	}
+	if s.lfn, err = template.New("lfn").Option("missingkey=error").Parse(r.Lfn); err != nil {
+		return nil, err
+	}
+	if s.dataset, err = template.New("dataset").Option("missingkey=error").Parse(r.Dataset); err != nil {
+		return nil, err
+	}
+	if s.block, err = template.New("block").Option("missingkey=error").Parse(r.Block); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// helper function to execute template over given data
+func execute(tmpl *template.Template, data map[string]string) (string, error) {
+	var buf bytes.Buffer
+	err := tmpl.Execute(&buf, data)
+	return buf.String(), err
+}
+
+// helper function to construct catalog entry of a file with given relative
+// path, it returns false if path does not match scan rule
+func (s *scanner) record(rpath, pfn string) (core.CatalogEntry, bool, error) {
+	var rec core.CatalogEntry
+	rpath = filepath.ToSlash(rpath)
+	data := make(map[string]string)
+	if s.pattern != nil {
+		match := s.pattern.FindStringSubmatch(rpath)
+		if match == nil {
+			return rec, false, nil
+		}
+		for i, name := range s.pattern.SubexpNames() {
+			if name != "" {
+				data[name] = match[i]
+			}
+		}
+	}
+	ext := filepath.Ext(rpath)
+	data["Root"] = s.root
+	data["Path"] = rpath
+	data["Dir"] = filepath.ToSlash(filepath.Dir(rpath))
+	data["Base"] = filepath.Base(rpath)
+	data["Name"] = strings.TrimSuffix(filepath.Base(rpath), ext)
+	data["Ext"] = ext
+	var err error
+	if rec.Dataset, err = execute(s.dataset, data); err != nil {
+		return rec, false, err
+	}
+	data["Dataset"] = rec.Dataset
+	if rec.Lfn, err = execute(s.lfn, data); err != nil {
+		return rec, false, err
+	}
+	if rec.Block, err = execute(s.block, data); err != nil {
+		return rec, false, err
+	}
+	rec.Pfn = pfn
+	return rec, true, nil
+}
+
+// ScanRecords walks given directory tree and returns catalog entries of
+// regular files matching given scan rule, hidden files and directories and
+// temporary files of transfers are skipped. Entries do not carry file sizes
+// and checksums.
+func ScanRecords(dir string, rule ScanRule) ([]core.CatalogEntry, error) {
+	var records []core.CatalogEntry
+	s, err := rule.compile()
+	if err != nil {
+		return records, err
+	}
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return records, err
+	}
+	s.root = filepath.Base(root)
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != root && strings.HasPrefix(info.Name(), ".") {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() || strings.HasSuffix(path, core.TempSuffix) {
+			return nil
+		}
+		rpath, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		rec, ok, err := s.record(rpath, path)
+		if err != nil {
+			return fmt.Errorf("Unable to apply scan rule to %s, %v", rpath, err)
+		}
+		if ok {
+			records = append(records, rec)
+		}
+		return nil
+	})
+	return records, err
+}
+
+// Scan function walks given directory tree, derives LFN, dataset and block
+// names of found files from scan rule stored in given file and registers the
+// files in agent TFC
+func Scan(agent, dir, ruleFile string, checksums []string, workers int) error {
+	var rule ScanRule
+	if ruleFile != "" {
+		c, e := ioutil.ReadFile(ruleFile)
+		if e != nil {
+			return fmt.Errorf("Unable to read %s, error=%v\n", ruleFile, e)
+		}
+		if e := json.Unmarshal(c, &rule); e != nil {
+			return fmt.Errorf("Unable to parse scan rule JSON file, %v\n", e)
+		}
+	}
+	records, err := ScanRecords(dir, rule)
+	if err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{
+		"Dir":   dir,
+		"Rule":  rule.String(),
+		"Files": len(records),
+	}).Info("Scanned")
+	if len(records) == 0 {
+		return nil
+	}
+	return registerRecords(agent, records, checksums, workers, false)
+}
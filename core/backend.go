@@ -0,0 +1,542 @@
+package core
+
+// transfer2go transfer backends implementation
+// Copyright (c) 2017 - Valentin Kuznetsov <vkuznet@gmail.com>
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+	"text/template/parse"
+	"time"
+	"unicode"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vkuznet/transfer2go/utils"
+)
+
+// Backend interface defines operations of a transfer backend. Put and Get
+// transfer a catalog entry between source and destination agents and return
+// entry of the file on destination, i.e. its PFN and checksums computed by
+// destination, while Stat, Delete and Checksum operate on files of the agent
+// storage.
+type Backend interface {
+	Put(c CatalogEntry, t *TransferRequest, srcAgent, dstAgent AgentStatus) (CatalogEntry, error)
+	Get(c CatalogEntry, t *TransferRequest, srcAgent, dstAgent AgentStatus) (CatalogEntry, error)
+	Stat(pfn string) (int64, error)
+	Delete(pfn string) error
+	Checksum(pfn string, algs ...string) (map[string]string, error)
+}
+
+// BulkBackend interface is implemented by backends which can transfer
+// multiple catalog entries within single session, it returns list of
+// successfully transferred records and TransferError if any record failed
+type BulkBackend interface {
+	PutMany(records []CatalogEntry, t *TransferRequest, srcAgent, dstAgent AgentStatus) ([]CatalogEntry, error)
+}
+
+// registered backends
+var (
+	_backends      = make(map[string]Backend)
+	_backendsMutex sync.RWMutex
+)
+
+// RegisterBackend registers backend for given protocol
+func RegisterBackend(protocol string, b Backend) {
+	_backendsMutex.Lock()
+	defer _backendsMutex.Unlock()
+	_backends[protocol] = b
+}
+
+// GetBackend returns backend for given protocol, HTTP backend is used if
+// protocol is not given and external tool backend for unknown protocols
+func GetBackend(protocol string) Backend {
+	if protocol == "" {
+		protocol = "http"
+	}
+	_backendsMutex.RLock()
+	defer _backendsMutex.RUnlock()
+	if b, ok := _backends[protocol]; ok {
+		return b
+	}
+	return ToolBackend{}
+}
+
+func init() {
+	RegisterBackend("http", HttpBackend{})
+}
+
+// helper function to construct PFN of given record within agent backend by
+// using agent mapping rules of given protocol, destination PFN of request of
+// the record file takes precedence
+func backendPfn(c CatalogEntry, t *TransferRequest, protocol string, agent AgentStatus) (string, error) {
+	if t.Pfn != "" && t.File == c.Lfn {
+		return t.Pfn, nil
+	}
+	return BackendPfn(agent.Rules, protocol, c.Lfn, agent.Backend)
+}
+
+// LocalStorage implements storage operations of Backend interface for files
+// on local filesystem
+type LocalStorage struct{}
+
+// Stat returns size of given pfn
+func (LocalStorage) Stat(pfn string) (int64, error) {
+	fi, err := os.Stat(pfn)
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// Delete removes given pfn
+func (LocalStorage) Delete(pfn string) error {
+	return os.Remove(pfn)
+}
+
+// Checksum returns checksums of given pfn for given algorithms
+func (LocalStorage) Checksum(pfn string, algs ...string) (map[string]string, error) {
+	file, err := os.Open(pfn)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	sums, _, err := utils.Checksums(file, algs...)
+	return sums, err
+}
+
+// ErrPfnConflict is returned when destination PFN holds a different file
+var ErrPfnConflict = errors.New("destination file exists with different checksum")
+
+// PreparePfn creates directories of given PFN. If PFN already exists it
+// verifies that it holds the same file, i.e. its checksum of given hash
+// algorithm matches given checksums, and returns ErrPfnConflict otherwise.
+func PreparePfn(pfn, hashType string, sums map[string]string) error {
+	if err := os.MkdirAll(filepath.Dir(pfn), 0755); err != nil {
+		return err
+	}
+	fi, err := os.Stat(pfn)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", pfn)
+	}
+	if hashType == "" {
+		hashType = utils.DefaultChecksum
+	}
+	existing, err := LocalStorage{}.Checksum(pfn, hashType)
+	if err != nil {
+		return err
+	}
+	if sum, ok := sums[hashType]; !ok || sum != existing[hashType] {
+		log.WithFields(log.Fields{
+			"PFN":      pfn,
+			"HashType": hashType,
+			"Hash":     sum,
+			"Existing": existing[hashType],
+		}).Error("Refuse to overwrite existing file")
+		return ErrPfnConflict
+	}
+	return nil
+}
+
+// helper function to prepare destination PFN of given record transferred by
+// given request, existing file is kept for repair requests and replaced once
+// its transfer is verified
+func preparePfn(c CatalogEntry, t *TransferRequest, pfn string) error {
+	if t.Repair {
+		return os.MkdirAll(filepath.Dir(pfn), 0755)
+	}
+	return PreparePfn(pfn, c.HashAlgorithm(), c.AllChecksums())
+}
+
+// TempSuffix is suffix of temporary files which hold data of a PFN until it
+// is fully written and verified
+const TempSuffix = ".t2gtmp"
+
+// suffix of temporary files of chunked uploads
+const chunkSuffix = ".chunks" + TempSuffix
+
+// helper function to record directory of temporary files in agent DB, it
+// allows to clean temporary files of interrupted transfers without scanning
+// whole storage of the agent
+func addTempDir(dir string) error {
+	_, err := DB.Exec(getSQL("insert_tempdirs"), dir, time.Now().Unix())
+	return err
+}
+
+// TempFile creates hidden temporary file in directory of given PFN
+func TempFile(pfn string) (*os.File, error) {
+	if err := addTempDir(filepath.Dir(pfn)); err != nil {
+		return nil, err
+	}
+	file, err := ioutil.TempFile(filepath.Dir(pfn), fmt.Sprintf(".%s.*%s", filepath.Base(pfn), TempSuffix))
+	if err != nil {
+		return nil, err
+	}
+	if err := file.Chmod(0644); err != nil {
+		DiscardFile(file)
+		return nil, err
+	}
+	return file, nil
+}
+
+// CommitFile syncs and closes given temporary file and atomically renames it
+// to given PFN, temporary file is removed on failure
+func CommitFile(file *os.File, pfn string) error {
+	err := file.Sync()
+	if e := file.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), pfn)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	return err
+}
+
+// DiscardFile closes and removes given temporary file
+func DiscardFile(file *os.File) {
+	file.Close()
+	os.Remove(file.Name())
+}
+
+// ChunkFile returns name of temporary file which collects chunks of given
+// PFN until its chunked upload is completed, unlike TempFile the name is
+// fixed since chunks of the file arrive in separate requests
+func ChunkFile(pfn string) string {
+	return filepath.Join(filepath.Dir(pfn), fmt.Sprintf(".%s%s", filepath.Base(pfn), chunkSuffix))
+}
+
+// OpenChunkFile opens for writing temporary file which collects chunks of
+// given PFN, the file is created if it does not exist
+func OpenChunkFile(pfn string) (*os.File, error) {
+	tmp := ChunkFile(pfn)
+	if err := os.MkdirAll(filepath.Dir(tmp), 0755); err != nil {
+		return nil, err
+	}
+	if err := addTempDir(filepath.Dir(tmp)); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE, 0644)
+}
+
+// MaxCleanErrors defines number of errors logged by CleanTempFiles
+var MaxCleanErrors = 10
+
+// ChunkExpire defines how long temporary files of chunked uploads are kept
+// since their last chunk, the upload can be resumed until then
+var ChunkExpire = 7 * 24 * time.Hour
+
+// CleanTempFiles removes temporary files left by interrupted transfers in
+// directories recorded in agent DB. Files of chunked uploads are kept until
+// they expire, chunks of removed files are discarded once their upload is
+// resumed. Paths which can't be accessed or removed are skipped. It returns
+// number of removed files and number of skipped paths.
+func CleanTempFiles() (int, int, error) {
+	var dirs []string
+	rows, err := DB.Query(getSQL("tempdirs"))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var dir string
+		if err := rows.Scan(&dir); err != nil {
+			return 0, 0, err
+		}
+		dirs = append(dirs, dir)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, 0, err
+	}
+	rows.Close()
+
+	var count, failed int
+	skip := func(path string, err error) {
+		failed++
+		if failed <= MaxCleanErrors {
+			log.WithFields(log.Fields{
+				"Path":  path,
+				"Error": err,
+			}).Warn("Unable to clean temporary files")
+		}
+	}
+	for _, dir := range dirs {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil && !os.IsNotExist(err) {
+			skip(dir, err)
+			continue
+		}
+		kept := 0
+		for _, fi := range files {
+			if !fi.Mode().IsRegular() || !strings.HasSuffix(fi.Name(), TempSuffix) {
+				continue
+			}
+			if strings.HasSuffix(fi.Name(), chunkSuffix) && time.Since(fi.ModTime()) < ChunkExpire {
+				kept++
+				continue
+			}
+			path := filepath.Join(dir, fi.Name())
+			if err := os.Remove(path); err != nil {
+				skip(path, err)
+				kept++
+				continue
+			}
+			count++
+		}
+		if kept == 0 {
+			if _, err := DB.Exec(getSQL("delete_tempdirs"), dir); err != nil {
+				return count, failed, err
+			}
+		}
+	}
+	return count, failed, nil
+}
+
+// HttpBackend transfers files via agents HTTP end-points
+type HttpBackend struct {
+	LocalStorage
+}
+
+// Put uploads given catalog entry to destination agent
+func (HttpBackend) Put(c CatalogEntry, t *TransferRequest, srcAgent, dstAgent AgentStatus) (CatalogEntry, error) {
+	log.WithFields(log.Fields{
+		"dstAgent": dstAgent.String(),
+	}).Println("Transfer via HTTP protocol to", dstAgent.String())
+	return httpTransfer(c, t, negotiateStreams(srcAgent, dstAgent))
+}
+
+// Get downloads given catalog entry from source agent into destination agent
+// backend, it is used by destination agent in pull mode
+func (HttpBackend) Get(c CatalogEntry, t *TransferRequest, srcAgent, dstAgent AgentStatus) (CatalogEntry, error) {
+	log.WithFields(log.Fields{
+		"srcAgent": srcAgent.String(),
+	}).Println("Pull via HTTP protocol from", srcAgent.String())
+	pfn, err := backendPfn(c, t, "http", dstAgent)
+	if err != nil {
+		return CatalogEntry{}, err
+	}
+	return httpDownload(c, t, pfn)
+}
+
+// PutMany uploads given catalog entries to destination agent in bulk sessions,
+// large files are transferred individually in chunks
+func (b HttpBackend) PutMany(records []CatalogEntry, t *TransferRequest, srcAgent, dstAgent AgentStatus) ([]CatalogEntry, error) {
+	log.WithFields(log.Fields{
+		"dstAgent": dstAgent.String(),
+		"Records":  len(records),
+		"BulkSize": BulkSize,
+	}).Println("Bulk transfer via HTTP protocol to", dstAgent.String())
+	var small, large []CatalogEntry
+	for _, rec := range records {
+		if ChunkSize > 0 && rec.Bytes > ChunkSize {
+			large = append(large, rec)
+		} else {
+			small = append(small, rec)
+		}
+	}
+	trRecords, err := bulkTransfer(small, t)
+	records, e := fileTransfers(b.Put, large, t, srcAgent, dstAgent)
+	trRecords = append(trRecords, records...)
+	failed := &TransferError{Total: len(small) + len(large)}
+	failed.merge(err)
+	failed.merge(e)
+	return trRecords, failed.failed()
+}
+
+// ToolArgs represents values which can be used in backend tool options,
+// e.g. "-f {{.Pfn}} root://host/{{.Lfn}}"
+type ToolArgs struct {
+	Pfn     string // source PFN
+	Rpfn    string // remote PFN, i.e. destination backend followed by LFN
+	Lfn     string // LFN of the file
+	Backend string // destination agent backend
+	Bytes   int64  // size of the file
+	Hash    string // checksum of the file
+	Type    string // checksum algorithm of the hash, e.g. adler32
+}
+
+// ToolArguments returns list of tool arguments constructed from given
+// options which are a template over ToolArgs. Options are split into
+// arguments by white space outside of template actions, therefore values
+// with spaces remain single arguments, while output of control structures
+// like {{if}} is split by white space. If options do not refer to source and
+// remote PFNs they are appended to arguments.
+func ToolArguments(opts string, args ToolArgs) ([]string, error) {
+	tmpl, err := template.New("opts").Parse(opts)
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	var buf bytes.Buffer
+	word := false // current argument has content
+	flush := func() {
+		if word {
+			out = append(out, buf.String())
+			buf.Reset()
+			word = false
+		}
+	}
+	var root []parse.Node
+	if tmpl.Tree != nil {
+		root = tmpl.Tree.Root.Nodes
+	}
+	for _, node := range root {
+		if text, ok := node.(*parse.TextNode); ok {
+			s := string(text.Text)
+			for s != "" {
+				i := strings.IndexFunc(s, unicode.IsSpace)
+				if i < 0 {
+					buf.WriteString(s)
+					word = true
+					break
+				}
+				if i > 0 {
+					buf.WriteString(s[:i])
+					word = true
+				}
+				flush()
+				s = strings.TrimLeftFunc(s[i:], unicode.IsSpace)
+			}
+			continue
+		}
+		// render template action into current argument, output of control
+		// structures, e.g. if or range, is split by white space
+		tree := &parse.Tree{Root: &parse.ListNode{NodeType: parse.NodeList, Nodes: []parse.Node{node}}}
+		action, err := tmpl.New("arg").AddParseTree("arg", tree)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := node.(*parse.ActionNode); ok {
+			if err := action.Execute(&buf, args); err != nil {
+				return nil, err
+			}
+			word = true
+			continue
+		}
+		var block bytes.Buffer
+		if err := action.Execute(&block, args); err != nil {
+			return nil, err
+		}
+		fields := strings.Fields(block.String())
+		if len(fields) > 0 && unicode.IsSpace(rune(block.String()[0])) {
+			flush()
+		}
+		for i, f := range fields {
+			if i > 0 {
+				flush()
+			}
+			buf.WriteString(f)
+			word = true
+		}
+		if n := block.Len(); n > 0 && unicode.IsSpace(rune(block.String()[n-1])) {
+			flush()
+		}
+	}
+	flush()
+	if tmpl.Tree == nil || !usesFields(tmpl.Tree.Root, "Pfn", "Rpfn") {
+		out = append(out, args.Pfn, args.Rpfn)
+	}
+	return out, nil
+}
+
+// helper function to check whether template node refers to any of given
+// fields of its data
+func usesFields(node parse.Node, fields ...string) bool {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return false
+		}
+		for _, c := range n.Nodes {
+			if usesFields(c, fields...) {
+				return true
+			}
+		}
+	case *parse.ActionNode:
+		return usesFields(n.Pipe, fields...)
+	case *parse.PipeNode:
+		if n == nil {
+			return false
+		}
+		for _, c := range n.Cmds {
+			if usesFields(c, fields...) {
+				return true
+			}
+		}
+	case *parse.CommandNode:
+		for _, c := range n.Args {
+			if usesFields(c, fields...) {
+				return true
+			}
+		}
+	case *parse.IfNode:
+		return usesFields(n.Pipe, fields...) || usesFields(n.List, fields...) || usesFields(n.ElseList, fields...)
+	case *parse.RangeNode:
+		return usesFields(n.Pipe, fields...) || usesFields(n.List, fields...) || usesFields(n.ElseList, fields...)
+	case *parse.WithNode:
+		return usesFields(n.Pipe, fields...) || usesFields(n.List, fields...) || usesFields(n.ElseList, fields...)
+	case *parse.FieldNode:
+		return utils.InList(n.Ident[0], fields)
+	case *parse.VariableNode:
+		return len(n.Ident) > 1 && n.Ident[0] == "$" && utils.InList(n.Ident[1], fields)
+	}
+	return false
+}
+
+// ToolBackend transfers files via external tool of source agent, e.g. xrdcp
+type ToolBackend struct {
+	LocalStorage
+}
+
+// Put copies given catalog entry to destination agent backend with the help
+// of source agent tool
+func (ToolBackend) Put(c CatalogEntry, t *TransferRequest, srcAgent, dstAgent AgentStatus) (CatalogEntry, error) {
+	// construct remote PFN by using destination agent mapping rules, or its
+	// backend and record LFN if no rule matches
+	rpfn, err := backendPfn(c, t, srcAgent.Protocol, dstAgent)
+	if err != nil {
+		return CatalogEntry{}, err
+	}
+	args, err := ToolArguments(srcAgent.ToolOpts, ToolArgs{Pfn: c.Pfn, Rpfn: rpfn, Lfn: c.Lfn, Backend: dstAgent.Backend, Bytes: c.Bytes, Hash: c.Hash, Type: c.HashAlgorithm()})
+	if err != nil {
+		return CatalogEntry{}, err
+	}
+	// perform transfer with the help of backend tool
+	cmd := exec.Command(srcAgent.Tool, args...)
+	log.WithFields(log.Fields{
+		"Command": cmd,
+	}).Println("Transfer command")
+	err = cmd.Run()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"Tool":         srcAgent.Tool,
+			"Tool options": srcAgent.ToolOpts,
+			"PFN":          c.Pfn,
+			"Remote PFN":   rpfn,
+			"Err":          err,
+		}).Error("Transfer")
+		return CatalogEntry{}, err
+	}
+	return CatalogEntry{Pfn: rpfn}, nil
+}
+
+// Get is not supported by external tools, pull requests of agents which use
+// them are rejected by CheckPull
+func (ToolBackend) Get(c CatalogEntry, t *TransferRequest, srcAgent, dstAgent AgentStatus) (CatalogEntry, error) {
+	return CatalogEntry{}, ErrPullNotSupported
+}
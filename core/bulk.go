@@ -0,0 +1,188 @@
+package core
+
+// transfer2go bulk transfer implementation
+// Copyright (c) 2017 - Valentin Kuznetsov <vkuznet@gmail.com>
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vkuznet/transfer2go/utils"
+)
+
+// BulkSize defines max number of files shipped in a single bulk transfer
+// session, values below two disable bulk transfers
+var BulkSize int
+
+// TransferResult represents result of a single file transfer within bulk transfer
+type TransferResult struct {
+	Lfn   string       `json:"lfn"`   // lfn of transferred file
+	Entry CatalogEntry `json:"entry"` // catalog entry of the file on destination
+	Error string       `json:"error"` // transfer error, empty on success
+}
+
+// String provides string representation of TransferResult
+func (r *TransferResult) String() string {
+	return fmt.Sprintf("<TransferResult lfn=%s entry=%s error=%s>", r.Lfn, r.Entry.String(), r.Error)
+}
+
+// helper function to write all given records into multipart writer, every
+// part carries meta-data of its record in part headers. Records which can't
+// be read are skipped and reported back as failed transfer results.
+func writeParts(writer *multipart.Writer, records []CatalogEntry) ([]TransferResult, error) {
+	var failed []TransferResult
+	for _, c := range records {
+		file, err := os.Open(c.Pfn)
+		if err != nil {
+			failed = append(failed, TransferResult{Lfn: c.Lfn, Error: err.Error()})
+			continue
+		}
+		h := make(textproto.MIMEHeader)
+		h.Set("Content-Disposition", mime.FormatMediaType("form-data", map[string]string{"name": "data", "filename": filepath.Base(c.Pfn)}))
+		h.Set("Content-Type", "application/octet-stream")
+		h.Set("Pfn", c.Pfn)
+		h.Set("Lfn", c.Lfn)
+		h.Set("Dataset", c.Dataset)
+		h.Set("Block", c.Block)
+		h.Set("Bytes", fmt.Sprintf("%d", c.Bytes))
+		setChecksumHeaders(h, c)
+		part, err := writer.CreatePart(h)
+		if err != nil {
+			file.Close()
+			return failed, err
+		}
+		_, err = io.Copy(part, file)
+		file.Close()
+		if err != nil {
+			return failed, err
+		}
+	}
+	return failed, writer.Close()
+}
+
+// helper function to perform bulk transfer of given records via HTTP protocol,
+// all records are streamed to destination agent within single HTTP request
+func httpBulkTransfer(records []CatalogEntry, t *TransferRequest) ([]TransferResult, error) {
+	pr, pw := io.Pipe()
+	writer := multipart.NewWriter(pw)
+
+	var failed []TransferResult
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		var err error
+		failed, err = writeParts(writer, records)
+		pw.CloseWithError(err)
+	}()
+
+	url := fmt.Sprintf("%s/bulkupload", t.DstUrl)
+	req, err := http.NewRequest("POST", url, pr)
+	if err != nil {
+		pr.CloseWithError(err)
+		wg.Wait()
+		return nil, err
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set("Src", t.SrcAlias)
+	req.Header.Set("Dst", t.DstAlias)
+	client := utils.HttpClient()
+	resp, err := client.Do(req)
+	// unblock writer in case destination stopped reading our stream
+	pr.CloseWithError(fmt.Errorf("bulk transfer to %s is finished", url))
+	wg.Wait()
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bulk transfer to %s failed, status %s", url, resp.Status)
+	}
+
+	var results []TransferResult
+	err = json.NewDecoder(resp.Body).Decode(&results)
+	if err != nil {
+		return nil, err
+	}
+	return append(results, failed...), nil
+}
+
+// helper function to transfer records in bulk sessions of BulkSize records,
+// it returns list of successfully transferred records and TransferError if
+// any record failed
+func bulkTransfer(records []CatalogEntry, t *TransferRequest) ([]CatalogEntry, error) {
+	var trRecords []CatalogEntry // list of successfully transferred records
+	failed := &TransferError{Total: len(records)}
+	for i := 0; i < len(records); i += BulkSize {
+		end := i + BulkSize
+		if end > len(records) {
+			end = len(records)
+		}
+		chunk := records[i:end]
+
+		time0 := time.Now().Unix()
+		var chunkBytes int64
+		for _, rec := range chunk {
+			chunkBytes += rec.Bytes
+		}
+		AgentMetrics.Bytes.Inc(chunkBytes)
+
+		results, err := httpBulkTransfer(chunk, t)
+		AgentMetrics.Bytes.Dec(chunkBytes) // decrement since we're done with this session
+		if err != nil {
+			log.WithFields(log.Fields{
+				"TransferRequest": t.String(),
+				"Records":         len(chunk),
+				"Err":             err,
+			}).Error("Bulk transfer")
+			for _, rec := range chunk {
+				failed.add(rec.Lfn, err)
+			}
+			continue // if we fail on single session we continue with others
+		}
+
+		// match results with our records, records without results are failed
+		resMap := make(map[string]TransferResult)
+		for _, res := range results {
+			resMap[res.Lfn] = res
+		}
+		for _, rec := range chunk {
+			res, ok := resMap[rec.Lfn]
+			if !ok {
+				res.Error = "no transfer result from destination"
+			}
+			if res.Error != "" {
+				log.WithFields(log.Fields{
+					"TransferRequest": t.String(),
+					"Record":          rec.String(),
+					"Err":             res.Error,
+				}).Error("Bulk transfer of record")
+				failed.add(rec.Lfn, res.Error)
+				continue
+			}
+			r := transferredEntry(rec, res.Entry, time0)
+			trRecords = append(trRecords, r)
+
+			// record how much we transferred
+			AgentMetrics.TotalBytes.Inc(r.Bytes) // keep growing
+			AgentMetrics.Total.Inc(1)            // keep growing
+			t.addBytes(r.Bytes)
+		}
+	}
+	log.WithFields(log.Fields{
+		"TransferRequest": t.String(),
+		"Transferred":     len(trRecords),
+		"Failed":          len(failed.Lfns),
+	}).Println("Bulk transfer")
+	return trRecords, failed.failed()
+}
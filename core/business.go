@@ -24,20 +24,27 @@ type Metrics struct {
 
 // TransferRequest data type
 type TransferRequest struct {
-	TimeStamp int64  `json:"ts"`       // timestamp of the request
-	File      string `json:"file"`     // LFN name to be transferred
-	Block     string `json:"block"`    // block name to be transferred
-	Dataset   string `json:"dataset"`  // dataset name to be transferred
-	SrcUrl    string `json:"srcUrl"`   // source agent URL which initiate the transfer
-	SrcAlias  string `json:"srcAlias"` // source agent name
-	DstUrl    string `json:"dstUrl"`   // destination agent URL which will consume the transfer
-	DstAlias  string `json:"dstAlias"` // destination agent name
-	Delay     int    `json:"delay"`    // transfer delay time, i.e. post-pone transfer
+	Id        int64    `json:"id"`               // request id assigned by the agent
+	TimeStamp int64    `json:"ts"`               // timestamp of the request
+	File      string   `json:"file"`             // LFN name to be transferred
+	Block     string   `json:"block"`            // block name to be transferred
+	Dataset   string   `json:"dataset"`          // dataset name to be transferred
+	SrcUrl    string   `json:"srcUrl"`           // source agent URL which initiate the transfer
+	SrcAlias  string   `json:"srcAlias"`         // source agent name
+	DstUrl    string   `json:"dstUrl"`           // destination agent URL which will consume the transfer
+	DstAlias  string   `json:"dstAlias"`         // destination agent name
+	Delay     int      `json:"delay"`            // transfer delay time, i.e. post-pone transfer
+	Priority  int      `json:"priority"`         // transfer priority, requests with higher priority go first
+	Mode      string   `json:"mode"`             // transfer mode, source agent pushes or destination one pulls files
+	Failed    []string `json:"failed,omitempty"` // LFNs which failed in previous attempt, retry transfers only them
+	Repair    bool     `json:"repair,omitempty"` // replace existing destination files, e.g. corrupt ones, once transfer is verified
+	Pfn       string   `json:"pfn,omitempty"`    // destination PFN of the file, e.g. of repaired catalog entry, instead of PFN of agent mapping rules
 }
 
 // Job represents the job to be run
 type Job struct {
 	TransferRequest TransferRequest
+	seq             uint64 // order of the job in a queue
 }
 
 // Worker represents the worker that executes the job
@@ -79,15 +86,17 @@ func (m *Metrics) ToDict() map[string]int64 {
 
 // String method return string representation of transfer request
 func (t *TransferRequest) String() string {
-	return fmt.Sprintf("<TransferRequest ts=%d file=%s block=%s dataset=%s srcUrl=%s srcAlias=%s dstUrl=%s dstAlias=%s delay=%d>", t.TimeStamp, t.File, t.Block, t.Dataset, t.SrcUrl, t.SrcAlias, t.DstUrl, t.DstAlias, t.Delay)
+	return fmt.Sprintf("<TransferRequest id=%d ts=%d file=%s block=%s dataset=%s srcUrl=%s srcAlias=%s dstUrl=%s dstAlias=%s delay=%d priority=%d mode=%s repair=%v pfn=%s>", t.Id, t.TimeStamp, t.File, t.Block, t.Dataset, t.SrcUrl, t.SrcAlias, t.DstUrl, t.DstAlias, t.Delay, t.Priority, t.Mode, t.Repair, t.Pfn)
 }
 
 // Run method perform a job on transfer request
 func (t *TransferRequest) Run() error {
 	interval := time.Duration(t.Delay) * time.Second
+	// decorators are applied in order, the last one runs first, i.e. request
+	// is paused and checked for cancellation before its files are transferred
 	request := Decorate(DefaultProcessor,
-		Pause(interval), // will pause a given request for a given interval
 		Transfer(),
+		Pause(interval), // will pause a given request for a given interval
 	)
 	return request.Process(t)
 }
@@ -111,29 +120,46 @@ func (w Worker) Start() {
 
 			select {
 			case job := <-w.JobChannel:
+				// skip requests which were cancelled before they reached the worker
+				if job.TransferRequest.cancelled() {
+					logs.WithFields(logs.Fields{
+						"Transfer Request": job.TransferRequest.String(),
+					}).Println("Skip cancelled request")
+					continue
+				}
 				// Add info to agents metrics
 				AgentMetrics.In.Inc(1)
 				// we have received a work request.
-				if err := job.TransferRequest.Run(); err != nil {
+				if err := job.TransferRequest.Run(); err == ErrRequestCancelled {
+					logs.WithFields(logs.Fields{
+						"Transfer Request": job.TransferRequest.String(),
+					}).Println("Drop cancelled request")
+					AgentMetrics.In.Dec(1)
+					job.TransferRequest.SetStatus(RequestCancelled, nil)
+				} else if err != nil {
 					msg := fmt.Sprintf("WARNING %v experienced an error %v, put on hold", job.TransferRequest, err.Error())
-					// decide if we'll drop the request or put it on hold by increasing its delay and put back to job channel
+					// decide if we'll drop the request or put it on hold by increasing its delay and put back to job queue
 					if job.TransferRequest.Delay > 300 {
 						logs.WithFields(logs.Fields{
 							"Transfer Request":  job.TransferRequest,
 						}).Error("Exceed number of iteration, discard request")
 						AgentMetrics.Failed.Inc(1)
+						job.TransferRequest.SetStatus(RequestFailed, err)
 					} else if job.TransferRequest.Delay > 0 {
 						job.TransferRequest.Delay *= 2
 						logs.Println(msg)
-						w.JobChannel <- job
+						job.TransferRequest.hold(err)
+						w.retry(job)
 					} else {
 						job.TransferRequest.Delay = 60
 						logs.Println(msg)
-						w.JobChannel <- job
+						job.TransferRequest.hold(err)
+						w.retry(job)
 					}
 				} else {
 					// decrement transfer counter
 					AgentMetrics.In.Dec(1)
+					job.TransferRequest.SetStatus(RequestDone, nil)
 				}
 
 			case <-w.quit:
@@ -144,6 +170,14 @@ func (w Worker) Start() {
 	}()
 }
 
+// helper function to put failed job back on the job queue, the worker can't
+// send it to its own job channel since it is the only listener of it
+func (w Worker) retry(job Job) {
+	go func() {
+		JobQueue <- job
+	}()
+}
+
 // Stop signals the worker to stop listening for work requests.
 func (w Worker) Stop() {
 	go func() {
@@ -189,21 +223,38 @@ func (d *Dispatcher) Run() {
 	go d.dispatch()
 }
 
+// dispatch moves jobs from JobQueue into priority queue and hands them over
+// to idle workers, jobs with higher priority are dispatched first
 func (d *Dispatcher) dispatch() {
 	for {
 		select {
 		case job := <-JobQueue:
 			// a job request has been received
-			go func(job Job) {
-				// try to obtain a worker job channel that is available.
-				// this will block until a worker is idle
-				jobChannel := <-d.JobPool
-
-				// dispatch the job to the worker job channel
-				jobChannel <- job
-			}(job)
-		default:
-			time.Sleep(time.Duration(10) * time.Millisecond) // wait for a job
+			pushJob(job)
+		case jobChannel := <-d.JobPool:
+			// a worker is idle, dispatch the job to the worker job channel
+			jobChannel <- d.next()
+		}
+	}
+}
+
+// helper function which returns next job to run, it collects all jobs
+// available on JobQueue before making a decision and waits for a new job
+// if nothing is queued
+func (d *Dispatcher) next() Job {
+	for {
+	collect:
+		for {
+			select {
+			case job := <-JobQueue:
+				pushJob(job)
+			default:
+				break collect
+			}
+		}
+		if job, ok := popJob(); ok {
+			return job
 		}
+		pushJob(<-JobQueue)
 	}
 }
@@ -4,14 +4,18 @@ package core
 // Copyright (c) 2017 - Valentin Kuznetsov <vkuznet@gmail.com>
 
 import (
+	"bytes"
 	"database/sql"
 	"fmt"
-	"os/exec"
+	"net/url"
 	"strings"
 
+	"github.com/go-sql-driver/mysql"
 	log "github.com/sirupsen/logrus"
 	"github.com/vkuznet/transfer2go/utils"
 
+	// loads PostgreSQL database layer
+	_ "github.com/lib/pq"
 	// loads sqlite3 database layer
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -33,32 +37,26 @@ var TFC Catalog
 
 // CatalogEntry represents an entry in TFC
 type CatalogEntry struct {
-	Lfn          string `json:"lfn"`          // lfn stands for Logical File Name
-	Pfn          string `json:"pfn"`          // pfn stands for Physical File Name
-	Dataset      string `json:"dataset"`      // dataset represents collection of blocks
-	Block        string `json:"block"`        // block idetify single block within a dataset
-	Bytes        int64  `json:"bytes"`        // size of the files in bytes
-	Hash         string `json:"hash"`         // hash represents checksum of the pfn
-	TransferTime int64  `json:"transferTime"` // transfer time
-	Timestamp    int64  `json:"timestamp"`    // time stamp
+	Lfn          string            `json:"lfn"`                 // lfn stands for Logical File Name
+	Pfn          string            `json:"pfn"`                 // pfn stands for Physical File Name
+	Dataset      string            `json:"dataset"`             // dataset represents collection of blocks
+	Block        string            `json:"block"`               // block idetify single block within a dataset
+	Bytes        int64             `json:"bytes"`               // size of the files in bytes
+	Hash         string            `json:"hash"`                // hash represents checksum of the pfn
+	HashType     string            `json:"hashtype"`            // checksum algorithm of the hash, e.g. adler32
+	Checksums    map[string]string `json:"checksums,omitempty"` // all checksums of the pfn keyed by algorithm
+	TransferTime int64             `json:"transferTime"`        // transfer time
+	Timestamp    int64             `json:"timestamp"`           // time stamp
 }
 
 // Catalog represents Trivial File Catalog (TFC) of the model
 type Catalog struct {
-	Type     string `json:"type"`     // catalog type, e.g. sqlite3, etc.
-	Uri      string `json:"uri"`      // catalog uri, e.g. file.db
-	Login    string `json:"login"`    // database login
-	Password string `json:"password"` // database password
-	Owner    string `json:"owner"`    // used by ORACLE DB, defines owner of the database
-}
-
-func check(msg string, err error) {
-	if err != nil {
-		log.WithFields(log.Fields{
-			"Message": msg,
-			"Err":     err,
-		}).Fatal("Stop process")
-	}
+	Type     string   `json:"type"`     // catalog type, e.g. sqlite3, etc.
+	Uri      string   `json:"uri"`      // catalog uri, e.g. file.db
+	Login    string   `json:"login"`    // database login
+	Password string   `json:"password"` // database password
+	Owner    string   `json:"owner"`    // used by ORACLE DB, defines owner of the database
+	Rules    PfnRules `json:"rules"`    // LFN to PFN mapping rules
 }
 
 // LoadSQL is a helper function to load DBS SQL statements
@@ -86,110 +84,239 @@ func getSQL(key string) string {
 	return stm.(string)
 }
 
-// helper function to assign placeholder for SQL WHERE clause, it depends on database type
+// helper function to assign placeholder for SQL WHERE clause, it depends on
+// database type. Placeholders are positional, i.e. pholder is position of
+// the value in the list of statement values starting from 1.
 func placeholder(pholder string) string {
 	if DBTYPE == "ora" || DBTYPE == "oci8" {
 		return fmt.Sprintf(":%s", pholder)
-	} else if DBTYPE == "PostgreSQL" {
+	} else if DBTYPE == "postgres" {
 		return fmt.Sprintf("$%s", pholder)
 	} else {
 		return "?"
 	}
 }
 
+// helper function to execute insert statement and return id of inserted row,
+// PostgreSQL driver does not support LastInsertId and its insert statements
+// return the id instead
+func insertID(stm string, args ...interface{}) (int64, error) {
+	var id int64
+	if DBTYPE == "postgres" {
+		err := DB.QueryRow(stm, args...).Scan(&id)
+		return id, err
+	}
+	res, err := DB.Exec(stm, args...)
+	if err != nil {
+		return id, err
+	}
+	return res.LastInsertId()
+}
+
+// DSN returns data source name of the catalog database for its driver. The
+// catalog uri holds database location, e.g. file.db for sqlite3,
+// host:5432/tfc?sslmode=disable for postgres or tcp(host:3306)/tfc for mysql.
+// Catalog login and password are added to it unless uri defines the user.
+func (c *Catalog) DSN() (string, error) {
+	switch c.Type {
+	case "postgres":
+		uri := c.Uri
+		if !strings.Contains(uri, "://") {
+			uri = fmt.Sprintf("postgres://%s", uri)
+		}
+		u, err := url.Parse(uri)
+		if err != nil {
+			return "", err
+		}
+		if u.User == nil && c.Login != "" {
+			u.User = url.UserPassword(c.Login, c.Password)
+		}
+		return u.String(), nil
+	case "mysql":
+		cfg, err := mysql.ParseDSN(c.Uri)
+		if err != nil {
+			return "", err
+		}
+		if cfg.User == "" {
+			cfg.User = c.Login
+			cfg.Passwd = c.Password
+		}
+		return cfg.FormatDSN(), nil
+	}
+	return c.Uri, nil
+}
+
 // String provides string representation of CatalogEntry
 func (c *CatalogEntry) String() string {
-	return fmt.Sprintf("<CatalogEntry: dataset=%s block=%s lfn=%s pfn=%s bytes=%d hash=%s transferTime=%d timestamp=%d>", c.Dataset, c.Block, c.Lfn, c.Pfn, c.Bytes, c.Hash, c.TransferTime, c.Timestamp)
+	return fmt.Sprintf("<CatalogEntry: dataset=%s block=%s lfn=%s pfn=%s bytes=%d hash=%s hashtype=%s checksums=%s transferTime=%d timestamp=%d>", c.Dataset, c.Block, c.Lfn, c.Pfn, c.Bytes, c.Hash, c.HashAlgorithm(), utils.FormatChecksums(c.Checksums), c.TransferTime, c.Timestamp)
 }
 
 // Dump method returns TFC dump in CSV format
 func (c *Catalog) Dump() []byte {
-	if c.Type == "sqlite3" {
-		//         cmd := fmt.Sprintf("sqlite3 %s .dump", c.Uri)
-		out, err := exec.Command("sqlite3", c.Uri, ".dump").Output()
-		if err != nil {
-			log.WithFields(log.Fields{
-				"Err": err,
-			}).Error("c.Dump")
-		}
-		return out
+	var buf bytes.Buffer
+	if err := c.Export(&buf, ExportCSV, CatalogQuery{}); err != nil {
+		log.WithFields(log.Fields{
+			"Err": err,
+		}).Error("c.Dump")
 	}
-	log.WithFields(log.Fields{
-		"Type": c.Type,
-	}).Println("Catalog Dump method is not implemented yet for")
+	return buf.Bytes()
+}
 
+// Validate checks that catalog entry defines its LFN, block and dataset
+func (c *CatalogEntry) Validate() error {
+	if c.Lfn == "" || c.Block == "" || c.Dataset == "" {
+		return fmt.Errorf("catalog entry must define lfn, block and dataset, %s", c.String())
+	}
 	return nil
 }
 
-// Add method adds entry to a catalog
+// Add method adds entry to a catalog, existing entry with the same LFN is
+// updated
 func (c *Catalog) Add(entry CatalogEntry) error {
+	return c.AddMany([]CatalogEntry{entry})
+}
 
-	// add entry to the catalog
-	tx, e := DB.Begin()
-	check("Unable to setup transaction", e)
-
-	var stm string
-	var did, bid int
-
-	// insert dataset into dataset tables
-	stm = getSQL("insert_datasets")
-	_, e = DB.Exec(stm, entry.Dataset)
-	if e != nil {
-		if !strings.Contains(e.Error(), "UNIQUE") {
-			check("Unable to insert into datasets table", e)
+// AddMany method adds entries to a catalog in single transaction, none of
+// the entries is added if any of them fails
+func (c *Catalog) AddMany(entries []CatalogEntry) error {
+	for _, entry := range entries {
+		if err := entry.Validate(); err != nil {
+			return err
 		}
 	}
-
-	// get dataset id
-	stm = getSQL("id_datasets")
-	rows, err := DB.Query(stm, entry.Dataset)
-	check("Unable to perform DB.Query over datasets table", err)
-	defer rows.Close()
-	for rows.Next() {
-		err = rows.Scan(&did)
-		check("Unable to scan rows for datasetid", err)
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
 	}
-
-	// insert block into block table
-	stm = getSQL("insert_blocks")
-	_, e = DB.Exec(stm, entry.Block)
-	if e != nil {
-		if !strings.Contains(e.Error(), "UNIQUE") {
-			check("Unable to insert into blocks table", e)
+	for _, entry := range entries {
+		if err := addEntry(tx, entry); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("unable to add %s to catalog, %v", entry.Lfn, err)
 		}
 	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if utils.VERBOSE > 0 {
+		log.WithFields(log.Fields{
+			"Entries": len(entries),
+		}).Println("Committed to Catalog")
+	}
+	return nil
+}
+
+// helper function to look up id of a row with given SQL within transaction,
+// it returns zero id if row does not exist
+func lookupID(tx *sql.Tx, key string, arg interface{}) (int64, error) {
+	var id int64
+	err := tx.QueryRow(getSQL(key), arg).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return id, err
+}
 
-	// get block id
-	stm = getSQL("id_blocks")
-	rows, err = DB.Query(stm, entry.Block)
-	check("Unable to DB.Query over blocks table", err)
-	for rows.Next() {
-		err = rows.Scan(&bid)
-		check("Unable to scan rows for datasetid", err)
+// helper function to add entry to catalog tables within given transaction
+func addEntry(tx *sql.Tx, entry CatalogEntry) error {
+	// insert dataset and block unless they exist and get their ids
+	if _, err := tx.Exec(getSQL("insert_datasets"), entry.Dataset); err != nil {
+		return err
+	}
+	did, err := lookupID(tx, "id_datasets", entry.Dataset)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(getSQL("insert_blocks"), entry.Block); err != nil {
+		return err
+	}
+	bid, err := lookupID(tx, "id_blocks", entry.Block)
+	if err != nil {
+		return err
 	}
 
-	// insert entry into files table
-	stm = getSQL("insert_files")
-	_, e = DB.Exec(stm, entry.Lfn, entry.Pfn, bid, did, entry.Bytes, entry.Hash, entry.TransferTime, entry.Timestamp)
-	if e != nil {
-		if !strings.Contains(e.Error(), "UNIQUE") {
-			check(fmt.Sprintf("Unable to DB.Exec(%s)", stm), e)
+	// insert new file or update existing one
+	fid, err := lookupID(tx, "id_files", entry.Lfn)
+	if err != nil {
+		return err
+	}
+	if fid == 0 {
+		_, err = tx.Exec(getSQL("insert_files"), entry.Lfn, entry.Pfn, bid, did, entry.Bytes, entry.Hash, entry.HashAlgorithm(), entry.TransferTime, entry.Timestamp)
+		if err == nil {
+			fid, err = lookupID(tx, "id_files", entry.Lfn)
+		}
+	} else {
+		_, err = tx.Exec(getSQL("update_files"), entry.Pfn, bid, did, entry.Bytes, entry.Hash, entry.HashAlgorithm(), entry.TransferTime, entry.Timestamp, fid)
+		if err == nil {
+			// checksums of previous version of the file are replaced
+			_, err = tx.Exec(getSQL("delete_checksums"), entry.Lfn)
 		}
 	}
+	if err != nil {
+		return err
+	}
 
-	tx.Commit()
+	// insert all checksums of the entry into checksums table
+	for alg, sum := range entry.AllChecksums() {
+		if _, err := tx.Exec(getSQL("insert_checksums"), fid, alg, sum); err != nil {
+			return err
+		}
+	}
 
-	if utils.VERBOSE > 0 {
+	if utils.VERBOSE > 1 {
 		log.WithFields(log.Fields{
 			"Entry":      entry.String(),
 			"Dataset Id": did,
 			"Block Id":   bid,
-		}).Println("Committed to Catalog")
+			"File Id":    fid,
+		}).Println("Add to Catalog")
 	}
-
 	return nil
 }
 
+// Delete method removes catalog entries matching given transfer request in
+// single transaction, blocks and datasets left without files are removed as
+// well. It returns removed entries.
+func (c *Catalog) Delete(req TransferRequest) ([]CatalogEntry, error) {
+	if req.File == "" && req.Block == "" && req.Dataset == "" {
+		return nil, fmt.Errorf("lfn, block or dataset is required to delete catalog entries")
+	}
+	tx, err := DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	records, err := c.records(tx, req)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if len(records) == 0 {
+		tx.Rollback()
+		return records, nil
+	}
+	for _, rec := range records {
+		for _, key := range []string{"delete_checksums", "delete_files"} {
+			if _, err := tx.Exec(getSQL(key), rec.Lfn); err != nil {
+				tx.Rollback()
+				return nil, fmt.Errorf("unable to delete %s from catalog, %v", rec.Lfn, err)
+			}
+		}
+	}
+	for _, key := range []string{"delete_orphan_blocks", "delete_orphan_datasets"} {
+		if _, err := tx.Exec(getSQL(key)); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	log.WithFields(log.Fields{
+		"Request": req.String(),
+		"Files":   len(records),
+	}).Println("Deleted from Catalog")
+	return records, nil
+}
+
 // Files returns list of files for specified conditions
 func (c *Catalog) Files(dataset, block, lfn string) []string {
 	var files []string
@@ -202,24 +329,44 @@ func (c *Catalog) Files(dataset, block, lfn string) []string {
 
 // Records returns catalog records for a given transfer request
 func (c *Catalog) Records(req TransferRequest) []CatalogEntry {
-	stm := getSQL("files_blocks_datasets")
+	out, err := c.records(DB, req)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"Request": req.String(),
+			"Error":   err,
+		}).Error("Unable to get catalog records")
+		return []CatalogEntry{}
+	}
+	return out
+}
+
+// querier is implemented by DB and its transactions
+type querier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// helper function to fetch catalog records for a given transfer request with
+// given querier, e.g. within transaction
+func (c *Catalog) records(db querier, req TransferRequest) ([]CatalogEntry, error) {
+	var where string
 	var cond []string
 	var vals []interface{}
 	if req.File != "" {
-		cond = append(cond, fmt.Sprintf("F.LFN=%s", placeholder("lfn")))
 		vals = append(vals, req.File)
+		cond = append(cond, fmt.Sprintf("F.LFN=%s", placeholder(fmt.Sprintf("%d", len(vals)))))
 	}
 	if req.Block != "" {
-		cond = append(cond, fmt.Sprintf("B.BLOCK=%s", placeholder("block")))
 		vals = append(vals, req.Block)
+		cond = append(cond, fmt.Sprintf("B.BLOCK=%s", placeholder(fmt.Sprintf("%d", len(vals)))))
 	}
 	if req.Dataset != "" {
-		cond = append(cond, fmt.Sprintf("D.DATASET=%s", placeholder("dataset")))
 		vals = append(vals, req.Dataset)
+		cond = append(cond, fmt.Sprintf("D.DATASET=%s", placeholder(fmt.Sprintf("%d", len(vals)))))
 	}
 	if len(cond) > 0 {
-		stm += fmt.Sprintf(" WHERE %s", strings.Join(cond, " AND "))
+		where = fmt.Sprintf(" WHERE %s", strings.Join(cond, " AND "))
 	}
+	stm := getSQL("files_blocks_datasets") + where
 
 	if utils.VERBOSE > 0 {
 		log.WithFields(log.Fields{
@@ -229,34 +376,71 @@ func (c *Catalog) Records(req TransferRequest) []CatalogEntry {
 	}
 
 	// fetch data from DB
-	rows, err := DB.Query(stm, vals...)
+	out := []CatalogEntry{}
+	rows, err := db.Query(stm, vals...)
 	if err != nil {
-		log.WithFields(log.Fields{
-			"Query": stm,
-			"Error": err,
-		}).Error("DB.Query")
-		return []CatalogEntry{}
+		return out, err
 	}
 	defer rows.Close()
-	var out []CatalogEntry
 	for rows.Next() {
 		rec := CatalogEntry{}
-		err := rows.Scan(&rec.Dataset, &rec.Block, &rec.Lfn, &rec.Pfn, &rec.Bytes, &rec.Hash)
+		var hashType sql.NullString
+		err := rows.Scan(&rec.Dataset, &rec.Block, &rec.Lfn, &rec.Pfn, &rec.Bytes, &rec.Hash, &hashType)
 		if err != nil {
-			log.WithFields(log.Fields{
-				"Err": err,
-			}).Error("rows.Scan")
+			return out, err
 		}
+		rec.HashType = hashType.String
 		out = append(out, rec)
 	}
-	return out
+	if err := rows.Err(); err != nil {
+		return out, err
+	}
+	rows.Close()
+	if len(out) == 0 {
+		return out, nil
+	}
+
+	// fetch all checksums of the records
+	sums, err := c.checksums(db, getSQL("checksums_files")+where, vals)
+	if err != nil {
+		return out, err
+	}
+	for i := range out {
+		if v, ok := sums[out[i].Lfn]; ok {
+			out[i].Checksums = v
+		}
+		out[i].HashType = out[i].HashAlgorithm()
+	}
+	return out, nil
+}
+
+// helper function to fetch checksums of files for given query, it returns
+// checksums keyed by lfn and algorithm
+func (c *Catalog) checksums(db querier, stm string, vals []interface{}) (map[string]map[string]string, error) {
+	out := make(map[string]map[string]string)
+	rows, err := db.Query(stm, vals...)
+	if err != nil {
+		return out, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var lfn, alg, sum string
+		if err := rows.Scan(&lfn, &alg, &sum); err != nil {
+			return out, err
+		}
+		if _, ok := out[lfn]; !ok {
+			out[lfn] = make(map[string]string)
+		}
+		out[lfn][alg] = sum
+	}
+	return out, rows.Err()
 }
 
 // Transfers method returns transfers of the agent in given time interval
 func (c *Catalog) Transfers(time0, time1 string) []CatalogEntry {
 	stm := getSQL("transfers")
 	var vals []interface{}
-	stm += fmt.Sprintf(" WHERE TIMESTAMP>=%s AND TIMESTAMP<=%s", time0, time1)
+	stm += fmt.Sprintf(" WHERE TIMESTAMP>=%s AND TIMESTAMP<=%s", placeholder("1"), placeholder("2"))
 	vals = append(vals, time0)
 	vals = append(vals, time1)
 
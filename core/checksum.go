@@ -0,0 +1,117 @@
+package core
+
+// transfer2go checksums of catalog entries
+// Copyright (c) 2017 - Valentin Kuznetsov <vkuznet@gmail.com>
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/vkuznet/transfer2go/utils"
+)
+
+// Checksums defines checksum algorithms computed by the agent for every file
+// it receives in addition to those provided by the source agent
+var Checksums []string
+
+// headerSetter is implemented by http.Header and textproto.MIMEHeader
+type headerSetter interface {
+	Set(key, value string)
+}
+
+// headerGetter is implemented by http.Header and textproto.MIMEHeader
+type headerGetter interface {
+	Get(key string) string
+}
+
+// HashAlgorithm returns checksum algorithm of the entry hash
+func (c *CatalogEntry) HashAlgorithm() string {
+	if c.HashType == "" {
+		return utils.DefaultChecksum
+	}
+	return strings.ToLower(c.HashType)
+}
+
+// AllChecksums returns all known checksums of the entry keyed by algorithm
+func (c *CatalogEntry) AllChecksums() map[string]string {
+	out := make(map[string]string)
+	for alg, sum := range c.Checksums {
+		out[alg] = sum
+	}
+	if c.Hash != "" {
+		out[c.HashAlgorithm()] = c.Hash
+	}
+	return out
+}
+
+// SetChecksums sets checksums of the entry, its hash is set to the checksum
+// of the entry hash algorithm
+func (c *CatalogEntry) SetChecksums(sums map[string]string) {
+	c.HashType = c.HashAlgorithm()
+	c.Hash = sums[c.HashType]
+	c.Checksums = sums
+}
+
+// ChecksumTypes returns list of checksum algorithms to compute for a file
+// with given hash algorithm and checksums, i.e. algorithms of the source
+// agent which we verify and algorithms configured for this agent
+func ChecksumTypes(hashType string, sums map[string]string) []string {
+	if hashType == "" {
+		hashType = utils.DefaultChecksum
+	}
+	out := []string{hashType}
+	var algs []string
+	for alg := range sums {
+		algs = append(algs, alg)
+	}
+	sort.Strings(algs)
+	algs = append(algs, Checksums...)
+	for _, alg := range algs {
+		if !utils.InList(alg, out) {
+			out = append(out, alg)
+		}
+	}
+	return out
+}
+
+// VerifyChecksums compares expected checksums with computed ones
+func VerifyChecksums(expected, computed map[string]string) error {
+	var algs []string
+	for alg := range expected {
+		algs = append(algs, alg)
+	}
+	sort.Strings(algs)
+	for _, alg := range algs {
+		sum, ok := computed[alg]
+		if !ok {
+			return fmt.Errorf("%s checksum is not computed", alg)
+		}
+		if sum != expected[alg] {
+			return fmt.Errorf("%s checksum mismatch, source %s, received %s", alg, expected[alg], sum)
+		}
+	}
+	return nil
+}
+
+// helper function to set checksums of given entry in HTTP headers
+func setChecksumHeaders(h headerSetter, c CatalogEntry) {
+	h.Set("Hash", c.Hash)
+	h.Set("Hash-Type", c.HashAlgorithm())
+	h.Set("Checksums", utils.FormatChecksums(c.AllChecksums()))
+}
+
+// HeaderChecksums returns hash algorithm and checksums of a file sent by
+// source agent in HTTP headers
+func HeaderChecksums(h headerGetter) (string, map[string]string, error) {
+	c := CatalogEntry{Hash: h.Get("Hash"), HashType: h.Get("Hash-Type")}
+	if _, err := utils.NewHasher(c.HashAlgorithm()); err != nil {
+		return "", nil, err
+	}
+	sums, err := utils.ParseChecksums(h.Get("Checksums"))
+	if err != nil {
+		return "", nil, err
+	}
+	c.Checksums = sums
+	return c.HashAlgorithm(), c.AllChecksums(), nil
+}
@@ -0,0 +1,259 @@
+package core
+
+// transfer2go resumable chunked upload implementation
+// Copyright (c) 2017 - Valentin Kuznetsov <vkuznet@gmail.com>
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vkuznet/transfer2go/utils"
+)
+
+// ChunkSize defines size of chunks in bytes used to upload large files,
+// files which are not larger than a single chunk are uploaded at once
+var ChunkSize int64
+
+// Streams defines number of concurrent streams used to upload chunks of a file
+var Streams int
+
+// ChunkInfo represents a chunk of a file stored by the agent
+type ChunkInfo struct {
+	Offset int64  `json:"offset"` // offset of the chunk within a file
+	Bytes  int64  `json:"bytes"`  // size of the chunk
+	Hash   string `json:"hash"`   // checksum of the chunk
+}
+
+// UploadState represents state of chunked upload of a file
+type UploadState struct {
+	Lfn    string        `json:"lfn"`             // lfn of uploaded file
+	Offset int64         `json:"offset"`          // offset to resume upload from
+	Chunks []ChunkInfo   `json:"chunks"`          // list of stored chunks
+	Entry  *CatalogEntry `json:"entry,omitempty"` // catalog entry of completed upload
+}
+
+// String provides string representation of UploadState
+func (u *UploadState) String() string {
+	return fmt.Sprintf("<UploadState lfn=%s offset=%d chunks=%d>", u.Lfn, u.Offset, len(u.Chunks))
+}
+
+// StoredChunks returns chunks of given lfn stored by the agent, chunks which
+// belong to another version of the file (identified by its hash) are discarded
+func StoredChunks(lfn, fileHash string) ([]ChunkInfo, error) {
+	var out []ChunkInfo
+	rows, err := DB.Query(getSQL("chunks"), lfn)
+	if err != nil {
+		return out, err
+	}
+	defer rows.Close()
+	stale := false
+	for rows.Next() {
+		var fhash string
+		var c ChunkInfo
+		err := rows.Scan(&fhash, &c.Offset, &c.Bytes, &c.Hash)
+		if err != nil {
+			return out, err
+		}
+		if fhash != fileHash {
+			stale = true
+			continue
+		}
+		out = append(out, c)
+	}
+	if err := rows.Err(); err != nil {
+		return out, err
+	}
+	if stale {
+		log.WithFields(log.Fields{
+			"Lfn":  lfn,
+			"Hash": fileHash,
+		}).Warn("Discard chunks of another version of the file")
+		return nil, DeleteChunks(lfn)
+	}
+	return out, nil
+}
+
+// AddChunk records stored chunk of given lfn in agent DB
+func AddChunk(lfn, fileHash string, c ChunkInfo) error {
+	_, err := DB.Exec(getSQL("insert_chunks"), lfn, fileHash, c.Offset, c.Bytes, c.Hash, time.Now().Unix())
+	return err
+}
+
+// DeleteChunks removes all chunk records of given lfn from agent DB
+func DeleteChunks(lfn string) error {
+	_, err := DB.Exec(getSQL("delete_chunks"), lfn)
+	return err
+}
+
+// ResumeOffset returns end of contiguous sequence of chunks started at zero
+// offset, the upload can be safely resumed from it
+func ResumeOffset(chunks []ChunkInfo) int64 {
+	var offset int64
+	for _, c := range chunks {
+		if c.Offset != offset {
+			break
+		}
+		offset += c.Bytes
+	}
+	return offset
+}
+
+// MissingChunks returns list of chunks of given size which are required to
+// complete a file of total bytes, stored chunks should be ordered by offset
+func MissingChunks(chunks []ChunkInfo, total, size int64) []ChunkInfo {
+	var out []ChunkInfo
+	split := func(start, end int64) {
+		for pos := start; pos < end; pos += size {
+			bytes := size
+			if pos+bytes > end {
+				bytes = end - pos
+			}
+			out = append(out, ChunkInfo{Offset: pos, Bytes: bytes})
+		}
+	}
+	var pos int64
+	for _, c := range chunks {
+		if c.Offset > pos {
+			split(pos, c.Offset)
+		}
+		if end := c.Offset + c.Bytes; end > pos {
+			pos = end
+		}
+	}
+	if pos < total {
+		split(pos, total)
+	}
+	return out
+}
+
+// helper function to fetch upload state of given record from destination agent
+func uploadState(c CatalogEntry, t *TransferRequest) (UploadState, error) {
+	var state UploadState
+	rurl := fmt.Sprintf("%s/chunk?lfn=%s&hash=%s", t.DstUrl, url.QueryEscape(c.Lfn), url.QueryEscape(c.Hash))
+	resp := utils.FetchResponse(rurl, []byte{})
+	if resp.Error != nil {
+		return state, resp.Error
+	}
+	if resp.StatusCode != http.StatusOK {
+		return state, fmt.Errorf("unable to get upload state of %s, status %s", c.Lfn, resp.Status)
+	}
+	err := json.Unmarshal(resp.Data, &state)
+	return state, err
+}
+
+// helper function to upload a single chunk of the file
+func uploadChunk(file *os.File, c CatalogEntry, t *TransferRequest, offset, size int64) (UploadState, error) {
+	var state UploadState
+	hash, _, err := utils.HashReader(io.NewSectionReader(file, offset, size))
+	if err != nil {
+		return state, err
+	}
+	rurl := fmt.Sprintf("%s/chunk", t.DstUrl)
+	req, err := http.NewRequest("POST", rurl, io.NewSectionReader(file, offset, size))
+	if err != nil {
+		return state, err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Lfn", c.Lfn)
+	req.Header.Set("Dataset", c.Dataset)
+	req.Header.Set("Block", c.Block)
+	req.Header.Set("Bytes", fmt.Sprintf("%d", c.Bytes))
+	setChecksumHeaders(req.Header, c)
+	req.Header.Set("Offset", fmt.Sprintf("%d", offset))
+	req.Header.Set("Chunk-Hash", hash)
+	req.Header.Set("Src", t.SrcAlias)
+	req.Header.Set("Dst", t.DstAlias)
+	client := utils.HttpClient()
+	resp, err := client.Do(req)
+	if err != nil {
+		return state, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return state, fmt.Errorf("upload of %s chunk at offset %d failed, status %s", c.Lfn, offset, resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&state)
+	return state, err
+}
+
+// helper function to perform chunked transfer via HTTP protocol, chunks are
+// uploaded concurrently within given number of streams and the upload is
+// resumed from chunks already stored by destination agent. It returns catalog
+// entry of completed upload.
+func chunkedTransfer(c CatalogEntry, t *TransferRequest, streams int) (CatalogEntry, error) {
+	state, err := uploadState(c, t)
+	if err != nil {
+		return CatalogEntry{}, err
+	}
+	missing := MissingChunks(state.Chunks, c.Bytes, ChunkSize)
+	if len(state.Chunks) > 0 {
+		log.WithFields(log.Fields{
+			"Record":  c.String(),
+			"Stored":  len(state.Chunks),
+			"Missing": len(missing),
+		}).Println("Resume chunked transfer")
+	}
+	if len(missing) == 0 && len(state.Chunks) > 0 {
+		// all chunks are stored but upload was not completed, re-send last
+		// chunk to let destination complete the upload
+		missing = state.Chunks[len(state.Chunks)-1:]
+	}
+	file, err := os.Open(c.Pfn)
+	if err != nil {
+		return CatalogEntry{}, err
+	}
+	defer file.Close()
+
+	if streams < 1 {
+		streams = 1
+	}
+	var entry *CatalogEntry
+	var firstErr error
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	chunks := make(chan ChunkInfo)
+	for i := 0; i < streams; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ch := range chunks {
+				mutex.Lock()
+				failed := firstErr != nil
+				mutex.Unlock()
+				if failed {
+					continue // drain remaining chunks
+				}
+				st, err := uploadChunk(file, c, t, ch.Offset, ch.Bytes)
+				mutex.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = err
+				}
+				if st.Entry != nil {
+					entry = st.Entry
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+	for _, ch := range missing {
+		chunks <- ch
+	}
+	close(chunks)
+	wg.Wait()
+
+	if firstErr != nil {
+		return CatalogEntry{}, firstErr
+	}
+	if entry == nil {
+		return CatalogEntry{}, fmt.Errorf("upload of %s is not completed by destination", c.Lfn)
+	}
+	return *entry, nil
+}
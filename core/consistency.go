@@ -0,0 +1,364 @@
+package core
+
+// transfer2go consistency check of Trivial File Catalog against agent storage
+// Copyright (c) 2017 - Valentin Kuznetsov <vkuznet@gmail.com>
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vkuznet/transfer2go/utils"
+)
+
+// statuses of files reported by consistency check
+const (
+	FileMissing = "missing" // catalog entry without file in storage
+	FileCorrupt = "corrupt" // file size or checksum does not match catalog entry
+	FileOrphan  = "orphan"  // file in storage without catalog entry
+	FileError   = "error"   // file can't be checked, e.g. permission denied
+)
+
+// FileProblem represents file which failed consistency check
+type FileProblem struct {
+	Lfn     string `json:"lfn,omitempty"`     // LFN of catalog entry, empty for orphans
+	Pfn     string `json:"pfn"`               // PFN of the file
+	Status  string `json:"status"`            // missing, corrupt, orphan or error
+	Reason  string `json:"reason"`            // details of the problem
+	Repair  string `json:"repair,omitempty"`  // outcome of repair of the file
+	Request int64  `json:"request,omitempty"` // id of transfer request which repairs the file
+}
+
+// RepairFunc repairs missing or corrupt file of given catalog entry, e.g. by
+// queueing transfer of its replica from another agent. It returns id of
+// queued transfer request and description of performed action, or error if
+// the repair can't be started. Check does not wait for repair transfers.
+type RepairFunc func(rec CatalogEntry, p FileProblem) (int64, string, error)
+
+// ConsistencyCheck defines which catalog entries are checked against storage
+// of given protocol and directory where orphaned files are looked up. Quick
+// check compares only file sizes while full check also computes checksums.
+type ConsistencyCheck struct {
+	Protocol string       `json:"protocol"` // backend protocol used to access files
+	Dir      string       `json:"dir"`      // storage directory scanned for orphans, if empty orphans are not checked
+	Query    CatalogQuery `json:"query"`    // catalog entries to check
+	Quick    bool         `json:"quick"`    // compare sizes only
+	Repair   RepairFunc   `json:"-"`        // repairs missing and corrupt files if set
+}
+
+// ConsistencyReport represents results of consistency check, Finished is zero
+// while check is running
+type ConsistencyReport struct {
+	Started  int64         `json:"started"`         // start time of the check
+	Finished int64         `json:"finished"`        // finish time of the check
+	Quick    bool          `json:"quick"`           // checksums were not verified
+	Files    int64         `json:"files"`           // number of checked catalog entries
+	Bytes    int64         `json:"bytes"`           // number of checked bytes
+	Scanned  int64         `json:"scanned"`         // number of files scanned for orphans
+	Missing  int64         `json:"missing"`         // number of missing files
+	Corrupt  int64         `json:"corrupt"`         // number of corrupt files
+	Orphans  int64         `json:"orphans"`         // number of orphaned files
+	Errors   int64         `json:"errors"`          // number of files which can't be checked
+	Repairs  int64         `json:"repairs"`         // number of files with repair transfer requests
+	Requests []int64       `json:"requests"`        // ids of repair transfer requests
+	Problems []FileProblem `json:"problems"`        // files which failed the check, up to MaxProblems
+	Error    string        `json:"error,omitempty"` // error which stopped the check
+}
+
+// String provides string representation of ConsistencyReport
+func (r *ConsistencyReport) String() string {
+	return fmt.Sprintf("<ConsistencyReport started=%d finished=%d quick=%v files=%d bytes=%d scanned=%d missing=%d corrupt=%d orphans=%d errors=%d repairs=%d error=%s>", r.Started, r.Finished, r.Quick, r.Files, r.Bytes, r.Scanned, r.Missing, r.Corrupt, r.Orphans, r.Errors, r.Repairs, r.Error)
+}
+
+// MaxProblems defines number of file problems listed in consistency report,
+// all problems are counted
+var MaxProblems = 1000
+
+// helper function to record file problem in report
+func (r *ConsistencyReport) add(p FileProblem) {
+	switch p.Status {
+	case FileMissing:
+		r.Missing++
+	case FileCorrupt:
+		r.Corrupt++
+	case FileOrphan:
+		r.Orphans++
+	default:
+		r.Errors++
+	}
+	if len(r.Problems) < MaxProblems {
+		r.Problems = append(r.Problems, p)
+	}
+	log.WithFields(log.Fields{
+		"Lfn":    p.Lfn,
+		"Pfn":    p.Pfn,
+		"Status": p.Status,
+		"Reason": p.Reason,
+		"Repair": p.Repair,
+	}).Warn("Consistency check")
+}
+
+// state of consistency check, report holds results of running check or of
+// the last finished one
+var _consistency struct {
+	sync.Mutex
+	running bool
+	report  ConsistencyReport
+}
+
+// ConsistencyStatus returns whether consistency check is running and report
+// of running or last finished check, nil report means that no check was run
+func ConsistencyStatus() (bool, *ConsistencyReport) {
+	_consistency.Lock()
+	defer _consistency.Unlock()
+	if _consistency.report.Started == 0 {
+		return _consistency.running, nil
+	}
+	report := _consistency.report
+	report.Requests = append([]int64{}, report.Requests...)
+	report.Problems = append([]FileProblem{}, report.Problems...)
+	return _consistency.running, &report
+}
+
+// Start starts consistency check in background, it returns false if another
+// check is already running
+func (c ConsistencyCheck) Start() bool {
+	_consistency.Lock()
+	defer _consistency.Unlock()
+	if _consistency.running {
+		return false
+	}
+	_consistency.running = true
+	_consistency.report = ConsistencyReport{Started: time.Now().Unix(), Quick: c.Quick}
+	go c.run()
+	return true
+}
+
+// helper function to update report of running check
+func updateReport(fn func(r *ConsistencyReport)) {
+	_consistency.Lock()
+	fn(&_consistency.report)
+	_consistency.Unlock()
+}
+
+// helper function to run consistency check
+func (c ConsistencyCheck) run() {
+	log.WithFields(log.Fields{
+		"Protocol": c.Protocol,
+		"Dir":      c.Dir,
+		"Query":    c.Query.String(),
+		"Quick":    c.Quick,
+	}).Info("Start consistency check")
+	err := c.checkEntries()
+	if err == nil && c.Dir != "" {
+		err = c.checkOrphans()
+	}
+	_consistency.Lock()
+	defer _consistency.Unlock()
+	if err != nil {
+		_consistency.report.Error = err.Error()
+	}
+	_consistency.report.Finished = time.Now().Unix()
+	_consistency.running = false
+	log.WithFields(log.Fields{
+		"Report": _consistency.report.String(),
+	}).Info("Finished consistency check")
+}
+
+// CheckPageSize defines number of catalog entries fetched from DB at once
+// during consistency check, DB is not locked while files are checked
+var CheckPageSize = 1000
+
+// helper function to return ids of pending pull requests of single files
+// keyed by their LFNs, i.e. transfers into this agent which already repair
+// the files
+func pendingPulls() (map[string]int64, error) {
+	requests, err := PendingRequests()
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]int64)
+	for _, t := range requests {
+		if t.Mode == PullMode && t.File != "" {
+			out[t.File] = t.Id
+		}
+	}
+	return out, nil
+}
+
+// helper function to start repair of file problem unless the file is already
+// transferred by pending request, it returns id of repair transfer request
+func (c ConsistencyCheck) repair(rec CatalogEntry, p *FileProblem, pending map[string]int64) int64 {
+	if rid, ok := pending[rec.Lfn]; ok {
+		p.Repair = fmt.Sprintf("transferred by pending request %d", rid)
+		p.Request = rid
+		return rid
+	}
+	rid, msg, err := c.Repair(rec, *p)
+	if err != nil {
+		p.Repair = fmt.Sprintf("unable to repair, %v", err)
+		return 0
+	}
+	p.Repair = msg
+	p.Request = rid
+	pending[rec.Lfn] = rid
+	return rid
+}
+
+// helper function to verify that files of catalog entries exist in storage
+// and match their size and checksums, repairs of bad files are queued
+func (c ConsistencyCheck) checkEntries() error {
+	backend := GetBackend(c.Protocol)
+	var pending map[string]int64
+	if c.Repair != nil {
+		var err error
+		if pending, err = pendingPulls(); err != nil {
+			return err
+		}
+	}
+	q := c.Query
+	q.Limit = CheckPageSize
+	for {
+		var page []CatalogEntry
+		cursor, err := TFC.Query(q, func(rec CatalogEntry) error {
+			page = append(page, rec)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, rec := range page {
+			problem := c.checkEntry(backend, rec)
+			var rid int64
+			if problem != nil && c.Repair != nil && (problem.Status == FileMissing || problem.Status == FileCorrupt) {
+				rid = c.repair(rec, problem, pending)
+			}
+			updateReport(func(r *ConsistencyReport) {
+				r.Files++
+				r.Bytes += rec.Bytes
+				if rid != 0 {
+					r.Repairs++
+					r.Requests = append(r.Requests, rid)
+				}
+				if problem != nil {
+					r.add(*problem)
+				}
+			})
+		}
+		if cursor == "" {
+			return nil
+		}
+		q.Cursor = cursor
+	}
+}
+
+// helper function to check single catalog entry, it returns nil if file is
+// consistent with the entry
+func (c ConsistencyCheck) checkEntry(backend Backend, rec CatalogEntry) *FileProblem {
+	bytes, err := backend.Stat(rec.Pfn)
+	if os.IsNotExist(err) {
+		return &FileProblem{Lfn: rec.Lfn, Pfn: rec.Pfn, Status: FileMissing, Reason: "file does not exist"}
+	}
+	if err != nil {
+		return &FileProblem{Lfn: rec.Lfn, Pfn: rec.Pfn, Status: FileError, Reason: err.Error()}
+	}
+	if bytes != rec.Bytes {
+		return &FileProblem{Lfn: rec.Lfn, Pfn: rec.Pfn, Status: FileCorrupt, Reason: fmt.Sprintf("file size %d does not match catalog size %d", bytes, rec.Bytes)}
+	}
+	expect := rec.AllChecksums()
+	if c.Quick || len(expect) == 0 {
+		return nil
+	}
+	var algs []string
+	for alg := range expect {
+		if _, err := utils.NewHasher(alg); err == nil {
+			algs = append(algs, alg)
+		}
+	}
+	if len(algs) == 0 {
+		return nil
+	}
+	sums, err := backend.Checksum(rec.Pfn, algs...)
+	if err != nil {
+		return &FileProblem{Lfn: rec.Lfn, Pfn: rec.Pfn, Status: FileError, Reason: err.Error()}
+	}
+	for _, alg := range algs {
+		if sums[alg] != expect[alg] {
+			return &FileProblem{Lfn: rec.Lfn, Pfn: rec.Pfn, Status: FileCorrupt, Reason: fmt.Sprintf("%s checksum %s does not match catalog checksum %s", alg, sums[alg], expect[alg])}
+		}
+	}
+	return nil
+}
+
+// helper function to find files in storage directory which are not known to
+// the catalog, temporary files of ongoing transfers are skipped. Paths which
+// can't be read are reported as errors and the scan continues.
+func (c ConsistencyCheck) checkOrphans() error {
+	dir, err := filepath.Abs(c.Dir)
+	if err != nil {
+		return err
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			updateReport(func(r *ConsistencyReport) {
+				r.add(FileProblem{Pfn: path, Status: FileError, Reason: err.Error()})
+			})
+			return nil
+		}
+		if !info.Mode().IsRegular() || strings.HasSuffix(path, TempSuffix) {
+			return nil
+		}
+		known, err := knownPfn(path, cwd)
+		if err != nil {
+			return err
+		}
+		updateReport(func(r *ConsistencyReport) {
+			r.Scanned++
+			if !known {
+				r.add(FileProblem{Pfn: path, Status: FileOrphan, Reason: "file is not registered in catalog"})
+			}
+		})
+		return nil
+	})
+}
+
+// helper function to check whether catalog has entry of file with given
+// absolute path, catalog PFN can be either absolute or relative to agent
+// working directory
+func knownPfn(path, cwd string) (bool, error) {
+	pfns := []string{path}
+	if rel, err := filepath.Rel(cwd, path); err == nil && !strings.HasPrefix(rel, "..") {
+		pfns = append(pfns, rel)
+	}
+	for _, pfn := range pfns {
+		var lfn string
+		err := DB.QueryRow(getSQL("lfn_files"), pfn).Scan(&lfn)
+		if err == nil {
+			return true, nil
+		}
+		if err != sql.ErrNoRows {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// ConsistencyChecks starts given consistency check periodically with given
+// interval, check is skipped if previous one is still running
+func ConsistencyChecks(c ConsistencyCheck, interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if !c.Start() {
+			log.Warn("Consistency check is still running, skip scheduled check")
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package core
+
+// transfer2go export and import of Trivial File Catalog
+// Copyright (c) 2017 - Valentin Kuznetsov <vkuznet@gmail.com>
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/vkuznet/transfer2go/utils"
+)
+
+// ExportJSON and ExportCSV define formats of catalog export, ExportJSON is
+// JSON lines format where every line holds single catalog entry
+const (
+	ExportJSON = "jsonl"
+	ExportCSV  = "csv"
+)
+
+// columns of catalog export in CSV format
+var _exportColumns = []string{"dataset", "block", "lfn", "pfn", "bytes", "hash", "hashtype", "checksums", "transferTime", "timestamp"}
+
+// Export method writes catalog entries matching given query in given format,
+// entries are streamed as they are read from DB
+func (c *Catalog) Export(w io.Writer, format string, q CatalogQuery) error {
+	switch format {
+	case ExportJSON:
+		enc := json.NewEncoder(w)
+		_, err := c.Query(q, func(rec CatalogEntry) error {
+			return enc.Encode(rec)
+		})
+		return err
+	case ExportCSV:
+		writer := csv.NewWriter(w)
+		if err := writer.Write(_exportColumns); err != nil {
+			return err
+		}
+		_, err := c.Query(q, func(rec CatalogEntry) error {
+			return writer.Write([]string{rec.Dataset, rec.Block, rec.Lfn, rec.Pfn, fmt.Sprintf("%d", rec.Bytes), rec.Hash, rec.HashAlgorithm(), utils.FormatChecksums(rec.Checksums), fmt.Sprintf("%d", rec.TransferTime), fmt.Sprintf("%d", rec.Timestamp)})
+		})
+		writer.Flush()
+		if err != nil {
+			return err
+		}
+		return writer.Error()
+	}
+	return fmt.Errorf("unsupported export format %s", format)
+}
+
+// ReadEntries reads catalog entries exported in given format and passes them
+// to given function one by one. CSV columns are identified by header row,
+// missing columns are left empty.
+func ReadEntries(r io.Reader, format string, fn func(CatalogEntry) error) error {
+	switch format {
+	case ExportJSON:
+		dec := json.NewDecoder(r)
+		for {
+			var rec CatalogEntry
+			err := dec.Decode(&rec)
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err := fn(rec); err != nil {
+				return err
+			}
+		}
+	case ExportCSV:
+		reader := csv.NewReader(r)
+		reader.FieldsPerRecord = -1
+		header, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for line := 2; ; line++ {
+			row, err := reader.Read()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			rec, err := csvEntry(header, row)
+			if err != nil {
+				return fmt.Errorf("line %d, %v", line, err)
+			}
+			if err := fn(rec); err != nil {
+				return err
+			}
+		}
+	}
+	return fmt.Errorf("unsupported export format %s", format)
+}
+
+// helper function to construct catalog entry from CSV row with given header
+func csvEntry(header, row []string) (CatalogEntry, error) {
+	var rec CatalogEntry
+	var err error
+	for i, col := range header {
+		if i >= len(row) || row[i] == "" {
+			continue
+		}
+		val := row[i]
+		switch col {
+		case "dataset":
+			rec.Dataset = val
+		case "block":
+			rec.Block = val
+		case "lfn":
+			rec.Lfn = val
+		case "pfn":
+			rec.Pfn = val
+		case "bytes":
+			rec.Bytes, err = strconv.ParseInt(val, 10, 64)
+		case "hash":
+			rec.Hash = val
+		case "hashtype":
+			rec.HashType = val
+		case "checksums":
+			rec.Checksums, err = utils.ParseChecksums(val)
+		case "transferTime":
+			rec.TransferTime, err = strconv.ParseInt(val, 10, 64)
+		case "timestamp":
+			rec.Timestamp, err = strconv.ParseInt(val, 10, 64)
+		}
+		if err != nil {
+			return rec, fmt.Errorf("invalid %s, %v", col, err)
+		}
+	}
+	return rec, nil
+}
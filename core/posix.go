@@ -0,0 +1,116 @@
+package core
+
+// transfer2go POSIX backend for agents which share a filesystem
+// Copyright (c) 2017 - Valentin Kuznetsov <vkuznet@gmail.com>
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func init() {
+	RegisterBackend("posix", PosixBackend{})
+}
+
+// PosixBackend copies files directly between backend directories of agents
+// which share a filesystem. Files are hardlinked when both backends are on
+// the same device, otherwise their content is copied which lets the kernel
+// use copy_file_range (and reflinks on filesystems supporting them).
+type PosixBackend struct {
+	LocalStorage
+}
+
+// Put copies given catalog entry into destination agent backend
+func (b PosixBackend) Put(c CatalogEntry, t *TransferRequest, srcAgent, dstAgent AgentStatus) (CatalogEntry, error) {
+	pfn, err := backendPfn(c, t, "posix", dstAgent)
+	if err != nil {
+		return CatalogEntry{}, err
+	}
+	sums, err := b.copy(c, t, pfn)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"PFN":        c.Pfn,
+			"Remote PFN": pfn,
+			"Err":        err,
+		}).Error("POSIX transfer")
+		return CatalogEntry{}, err
+	}
+	return CatalogEntry{Pfn: pfn, Checksums: sums}, nil
+}
+
+// Get copies given catalog entry from source agent backend, since both agents
+// see the same filesystem it is the same operation as Put
+func (b PosixBackend) Get(c CatalogEntry, t *TransferRequest, srcAgent, dstAgent AgentStatus) (CatalogEntry, error) {
+	return b.Put(c, t, srcAgent, dstAgent)
+}
+
+// helper function to link or copy given record of transfer request to pfn and
+// verify its content, it returns checksums of the copy
+func (b PosixBackend) copy(c CatalogEntry, t *TransferRequest, pfn string) (map[string]string, error) {
+	if src, err := filepath.Abs(c.Pfn); err == nil {
+		if dst, err := filepath.Abs(pfn); err == nil && src == dst {
+			return nil, fmt.Errorf("source and destination of %s are the same file %s", c.Lfn, pfn)
+		}
+	}
+	if err := preparePfn(c, t, pfn); err != nil {
+		return nil, err
+	}
+	// link or copy the file to temporary name and rename it to pfn once the
+	// copy is verified
+	file, err := TempFile(pfn)
+	if err != nil {
+		return nil, err
+	}
+	tmp := file.Name()
+	file.Close()
+	os.Remove(tmp)
+	if err = os.Link(c.Pfn, tmp); err != nil {
+		log.WithFields(log.Fields{
+			"PFN":        c.Pfn,
+			"Remote PFN": pfn,
+			"Err":        err,
+		}).Println("Unable to link file, copy it")
+		err = copyFile(c.Pfn, tmp)
+	}
+	expected := c.AllChecksums()
+	var sums map[string]string
+	if err == nil {
+		sums, err = b.Checksum(tmp, ChecksumTypes(c.HashAlgorithm(), expected)...)
+	}
+	if err == nil {
+		err = VerifyChecksums(expected, sums)
+	}
+	if err == nil {
+		err = os.Rename(tmp, pfn)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return nil, fmt.Errorf("unable to copy %s, %v", c.Lfn, err)
+	}
+	return sums, nil
+}
+
+// helper function to copy content of src file into dst one
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if e := out.Close(); err == nil {
+		err = e
+	}
+	return err
+}
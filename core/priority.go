@@ -0,0 +1,173 @@
+package core
+
+// transfer2go priority queue of transfer requests
+// Copyright (c) 2017 - Valentin Kuznetsov <vkuznet@gmail.com>
+
+import (
+	"container/heap"
+	"errors"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrNoRequest is returned when request is not known to the agent
+var ErrNoRequest = errors.New("request not found")
+
+// ErrRequestState is returned when request can't be changed in its current state
+var ErrRequestState = errors.New("request is not queued or held")
+
+// ErrRequestCancelled is returned when request was cancelled while held by a worker
+var ErrRequestCancelled = errors.New("request is cancelled")
+
+// jobHeap implements heap.Interface over jobs, jobs with higher priority
+// come first and jobs of the same priority are kept in FIFO order
+type jobHeap []Job
+
+func (h jobHeap) Len() int { return len(h) }
+func (h jobHeap) Less(i, j int) bool {
+	if h[i].TransferRequest.Priority == h[j].TransferRequest.Priority {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].TransferRequest.Priority > h[j].TransferRequest.Priority
+}
+func (h jobHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *jobHeap) Push(x interface{}) { *h = append(*h, x.(Job)) }
+func (h *jobHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	job := old[n-1]
+	*h = old[:n-1]
+	return job
+}
+
+// jobs waiting for a worker along with cancelled requests and priority changes
+// of requests which are currently held by workers
+var (
+	_jobs       jobHeap
+	_jobsSeq    uint64
+	_jobsMutex  sync.Mutex
+	_cancelled  = make(map[int64]bool)
+	_priorities = make(map[int64]int)
+)
+
+// helper function to put a job into priority queue
+func pushJob(job Job) {
+	_jobsMutex.Lock()
+	defer _jobsMutex.Unlock()
+	rid := job.TransferRequest.Id
+	if _cancelled[rid] {
+		delete(_cancelled, rid)
+		return
+	}
+	job.TransferRequest.applyPriority()
+	_jobsSeq++
+	job.seq = _jobsSeq
+	heap.Push(&_jobs, job)
+}
+
+// helper function to get a job with highest priority from the queue
+func popJob() (Job, bool) {
+	_jobsMutex.Lock()
+	defer _jobsMutex.Unlock()
+	if _jobs.Len() == 0 {
+		return Job{}, false
+	}
+	return heap.Pop(&_jobs).(Job), true
+}
+
+// helper function to apply priority change made while request was held by
+// a worker, it should be called with acquired jobs mutex
+func (t *TransferRequest) applyPriority() {
+	if p, ok := _priorities[t.Id]; ok {
+		t.Priority = p
+		delete(_priorities, t.Id)
+	}
+}
+
+// helper function to check if request was cancelled while held by a worker
+func (t *TransferRequest) cancelled() bool {
+	_jobsMutex.Lock()
+	defer _jobsMutex.Unlock()
+	if _cancelled[t.Id] {
+		delete(_cancelled, t.Id)
+		return true
+	}
+	return false
+}
+
+// helper function to look-up request which can be changed by the user
+func changeableRequest(rid int64) (RequestRecord, error) {
+	records, err := Requests(rid)
+	if err != nil {
+		return RequestRecord{}, err
+	}
+	if len(records) == 0 {
+		return RequestRecord{}, ErrNoRequest
+	}
+	rec := records[0]
+	switch rec.Status {
+	case RequestQueued, RequestPaused, RequestRetrying:
+		return rec, nil
+	}
+	return rec, ErrRequestState
+}
+
+// CancelRequest cancels queued or held transfer request with given id
+func CancelRequest(rid int64) error {
+	rec, err := changeableRequest(rid)
+	if err != nil {
+		return err
+	}
+	_jobsMutex.Lock()
+	found := false
+	for i, job := range _jobs {
+		if job.TransferRequest.Id == rid {
+			heap.Remove(&_jobs, i)
+			found = true
+			break
+		}
+	}
+	if !found {
+		// request is either on its way to the queue or held by a worker
+		_cancelled[rid] = true
+	}
+	_jobsMutex.Unlock()
+	rec.Request.SetStatus(RequestCancelled, nil)
+	log.WithFields(log.Fields{
+		"Request": rec.Request.String(),
+	}).Println("Cancelled request")
+	return nil
+}
+
+// SetPriority changes priority of queued or held transfer request with given id
+func SetPriority(rid int64, priority int) error {
+	rec, err := changeableRequest(rid)
+	if err != nil {
+		return err
+	}
+	rec.Request.Priority = priority
+	err = rec.Request.Persist(rec.Status)
+	if err != nil {
+		return err
+	}
+	_jobsMutex.Lock()
+	found := false
+	for i, job := range _jobs {
+		if job.TransferRequest.Id == rid {
+			_jobs[i].TransferRequest.Priority = priority
+			heap.Fix(&_jobs, i)
+			found = true
+			break
+		}
+	}
+	if !found {
+		_priorities[rid] = priority
+	}
+	_jobsMutex.Unlock()
+	log.WithFields(log.Fields{
+		"Request":  rec.Request.String(),
+		"Priority": priority,
+	}).Println("Changed request priority")
+	return nil
+}
@@ -0,0 +1,158 @@
+package core
+
+// transfer2go pull mode implementation, destination agent fetches files
+// from the source one
+// Copyright (c) 2017 - Valentin Kuznetsov <vkuznet@gmail.com>
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vkuznet/transfer2go/utils"
+)
+
+// Transfer modes
+const (
+	PushMode = "push" // source agent sends files to destination one
+	PullMode = "pull" // destination agent fetches files from source one
+)
+
+// ErrPullNotSupported is returned when files of source agent can't be pulled,
+// e.g. it transfers files via external tool
+var ErrPullNotSupported = errors.New("protocol of source agent does not support pull transfers")
+
+// CheckPull verifies that destination agent can pull files of given request
+// with the backend of source agent protocol
+func CheckPull(t *TransferRequest) error {
+	srcAgent, err := agentStatus(t.SrcUrl)
+	if err != nil {
+		return err
+	}
+	if _, ok := GetBackend(srcAgent.Protocol).(ToolBackend); ok {
+		return ErrPullNotSupported
+	}
+	return nil
+}
+
+// helper function to fetch records of transfer request from source agent TFC
+func remoteRecords(t *TransferRequest) ([]CatalogEntry, error) {
+	var records []CatalogEntry
+	rurl := fmt.Sprintf("%s/tfc?lfn=%s&block=%s&dataset=%s", t.SrcUrl, url.QueryEscape(t.File), url.QueryEscape(t.Block), url.QueryEscape(t.Dataset))
+	resp := utils.FetchResponse(rurl, []byte{})
+	if resp.Error != nil {
+		return records, resp.Error
+	}
+	if resp.StatusCode != http.StatusOK {
+		return records, fmt.Errorf("unable to get records from %s, status %s", t.SrcUrl, resp.Status)
+	}
+	err := json.Unmarshal(resp.Data, &records)
+	return records, err
+}
+
+// helper function to download given record from source agent into pfn, the
+// content is verified against record size and checksums. It returns catalog
+// entry of downloaded file.
+func httpDownload(c CatalogEntry, t *TransferRequest, pfn string) (CatalogEntry, error) {
+	var entry CatalogEntry
+	if err := preparePfn(c, t, pfn); err != nil {
+		return entry, err
+	}
+	rurl := fmt.Sprintf("%s/download?lfn=%s", t.SrcUrl, url.QueryEscape(c.Lfn))
+	client := utils.HttpClient()
+	resp, err := client.Get(rurl)
+	if err != nil {
+		return entry, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return entry, fmt.Errorf("download of %s failed, status %s", c.Lfn, resp.Status)
+	}
+	expected := c.AllChecksums()
+	writer, err := utils.NewChecksumWriter(ChecksumTypes(c.HashAlgorithm(), expected)...)
+	if err != nil {
+		return entry, err
+	}
+	file, err := TempFile(pfn)
+	if err != nil {
+		return entry, err
+	}
+	// here is pipe: resp.Body->hashers->file
+	bytes, err := io.Copy(file, io.TeeReader(resp.Body, writer))
+	if err == nil && bytes != c.Bytes {
+		err = fmt.Errorf("bytes mismatch, source %d, received %d", c.Bytes, bytes)
+	}
+	if err == nil {
+		err = VerifyChecksums(expected, writer.Sums())
+	}
+	if err != nil {
+		DiscardFile(file)
+		return entry, err
+	}
+	if err := CommitFile(file, pfn); err != nil {
+		return entry, err
+	}
+	entry = CatalogEntry{Lfn: c.Lfn, Pfn: pfn, Dataset: c.Dataset, Block: c.Block, Bytes: bytes, HashType: c.HashAlgorithm()}
+	entry.SetChecksums(writer.Sums())
+	return entry, nil
+}
+
+// helper function to perform pull transfer of given request, it runs on
+// destination agent which fetches files from source agent and registers
+// them in its own TFC
+func pullTransfer(t *TransferRequest) error {
+	records, err := remoteRecords(t)
+	if err != nil {
+		return err
+	}
+	records = t.pending(records)
+	if len(records) == 0 {
+		// file does not exists in source TFC, nothing to do
+		log.WithFields(log.Fields{
+			"TransferRequest": t,
+		}).Warn("Does match anything in TFC of source agent\n", t)
+		return nil
+	}
+	dstAgent, err := agentStatus(t.DstUrl)
+	if err != nil {
+		return err
+	}
+	srcAgent, err := agentStatus(t.SrcUrl)
+	if err != nil {
+		return err
+	}
+
+	// fetch records with the backend of source agent protocol
+	backend := GetBackend(srcAgent.Protocol)
+	trRecords, terr := fileTransfers(backend.Get, records, t, srcAgent, dstAgent)
+
+	// register fetched records in our TFC, if registration fails all records
+	// of this attempt are fetched again
+	if len(trRecords) > 0 {
+		if err := TFC.AddMany(trRecords); err != nil {
+			log.WithFields(log.Fields{
+				"TransferRequest": t.String(),
+				"Records":         len(trRecords),
+				"Error":           err,
+			}).Error("Unable to register pulled records")
+			return err
+		}
+	}
+	// source agent has just confirmed that it holds fetched records
+	if err := transferReplicas(t, t.SrcAlias, t.SrcUrl, trRecords); err != nil {
+		log.WithFields(log.Fields{
+			"TransferRequest": t.String(),
+			"Error":           err,
+		}).Error("Unable to record replicas of source agent")
+	}
+	log.WithFields(log.Fields{
+		"TransferRequest": t.String(),
+		"Transferred":     len(trRecords),
+		"Records":         len(records),
+	}).Println("Pull transfer")
+	return terr
+}
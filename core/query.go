@@ -0,0 +1,270 @@
+package core
+
+// transfer2go catalog queries with filters, sorting and pagination
+// Copyright (c) 2017 - Valentin Kuznetsov <vkuznet@gmail.com>
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vkuznet/transfer2go/utils"
+)
+
+// CatalogQuery defines filters, sort order and page of catalog query. Lfn,
+// Block and Dataset are matched exactly unless they contain * wildcard, e.g.
+// /store/data/* matches all LFNs with given prefix. Zero values of size and
+// timestamp ranges and of Limit are not applied.
+type CatalogQuery struct {
+	Lfn      string // LFN pattern
+	Block    string // block pattern
+	Dataset  string // dataset pattern
+	MinBytes int64  // minimal file size
+	MaxBytes int64  // maximal file size
+	MinTime  int64  // minimal file timestamp
+	MaxTime  int64  // maximal file timestamp
+	Sort     string // sort key, lfn, block, dataset, bytes or timestamp, prefixed by - for descending order
+	Limit    int    // maximal number of entries to return
+	Cursor   string // cursor returned by previous query to get next page
+}
+
+// String provides string representation of CatalogQuery
+func (q *CatalogQuery) String() string {
+	return fmt.Sprintf("<CatalogQuery lfn=%s block=%s dataset=%s bytes=%d-%d time=%d-%d sort=%s limit=%d cursor=%s>", q.Lfn, q.Block, q.Dataset, q.MinBytes, q.MaxBytes, q.MinTime, q.MaxTime, q.Sort, q.Limit, q.Cursor)
+}
+
+// sortColumn defines column entries are sorted by, Name refers to the table
+// column and Alias to the column of query_files statement
+type sortColumn struct {
+	Name  string
+	Alias string
+}
+
+// columns entries can be sorted by
+var _sortColumns = map[string]sortColumn{
+	"lfn":       {"F.lfn", "lfn"},
+	"block":     {"B.block", "block"},
+	"dataset":   {"D.dataset", "dataset"},
+	"bytes":     {"F.bytes", "bytes"},
+	"timestamp": {"F.timestamp", "ts"},
+}
+
+// Validate checks that query has known sort key, valid cursor and
+// non-negative limit
+func (q *CatalogQuery) Validate() error {
+	if _, _, err := q.sortKey(); err != nil {
+		return err
+	}
+	if q.Limit < 0 {
+		return fmt.Errorf("invalid limit %d", q.Limit)
+	}
+	if q.Cursor != "" {
+		if _, err := decodeCursor(q.Cursor); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// helper function to return sort key and order of the query
+func (q *CatalogQuery) sortKey() (string, string, error) {
+	key := q.Sort
+	order := "ASC"
+	if strings.HasPrefix(key, "-") {
+		key = key[1:]
+		order = "DESC"
+	}
+	if key == "" {
+		key = "lfn"
+	}
+	if _, ok := _sortColumns[key]; !ok {
+		return "", "", fmt.Errorf("invalid sort key %s", q.Sort)
+	}
+	return key, order, nil
+}
+
+// queryCursor represents position of last entry of a page, i.e. value of
+// its sort key and file id
+type queryCursor struct {
+	Value string `json:"v,omitempty"` // value of string sort key
+	Num   int64  `json:"n,omitempty"` // value of numeric sort key
+	Id    int64  `json:"id"`          // file id
+}
+
+// helper function to decode query cursor
+func decodeCursor(cursor string) (queryCursor, error) {
+	var c queryCursor
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err == nil {
+		err = json.Unmarshal(data, &c)
+	}
+	if err != nil {
+		return c, fmt.Errorf("invalid cursor %s", cursor)
+	}
+	return c, nil
+}
+
+// helper function to encode cursor of given entry for given sort key
+func encodeCursor(key string, id int64, rec CatalogEntry) string {
+	c := queryCursor{Id: id}
+	switch key {
+	case "lfn":
+		c.Value = rec.Lfn
+	case "block":
+		c.Value = rec.Block
+	case "dataset":
+		c.Value = rec.Dataset
+	case "bytes":
+		c.Num = rec.Bytes
+	case "timestamp":
+		c.Num = rec.Timestamp
+	}
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// helper function to convert wildcard pattern into LIKE pattern escaped by !
+func likePattern(pattern string) string {
+	r := strings.NewReplacer("!", "!!", "%", "!%", "_", "!_", "*", "%")
+	return r.Replace(pattern)
+}
+
+// sqlArgs holds values of placeholders of SQL statement
+type sqlArgs []interface{}
+
+// helper function to add value of SQL statement, it returns its placeholder
+func (a *sqlArgs) add(val interface{}) string {
+	*a = append(*a, val)
+	return placeholder(fmt.Sprintf("%d", len(*a)))
+}
+
+// helper function to construct condition which matches given column with
+// given pattern, pattern with * wildcard is matched by LIKE
+func (a *sqlArgs) match(column, pattern string) string {
+	if strings.Contains(pattern, "*") {
+		return fmt.Sprintf("%s LIKE %s ESCAPE '!'", column, a.add(likePattern(pattern)))
+	}
+	return fmt.Sprintf("%s=%s", column, a.add(pattern))
+}
+
+// helper function to build SQL statement and its values for given query
+func (q *CatalogQuery) statement() (string, []interface{}, string, error) {
+	key, order, err := q.sortKey()
+	if err != nil {
+		return "", nil, "", err
+	}
+	column := _sortColumns[key]
+	var cond []string
+	var args sqlArgs
+	next := args.add
+	for _, f := range []struct{ column, pattern string }{{"F.lfn", q.Lfn}, {"B.block", q.Block}, {"D.dataset", q.Dataset}} {
+		if f.pattern != "" {
+			cond = append(cond, args.match(f.column, f.pattern))
+		}
+	}
+	if q.MinBytes > 0 {
+		cond = append(cond, fmt.Sprintf("F.bytes>=%s", next(q.MinBytes)))
+	}
+	if q.MaxBytes > 0 {
+		cond = append(cond, fmt.Sprintf("F.bytes<=%s", next(q.MaxBytes)))
+	}
+	if q.MinTime > 0 {
+		cond = append(cond, fmt.Sprintf("F.timestamp>=%s", next(q.MinTime)))
+	}
+	if q.MaxTime > 0 {
+		cond = append(cond, fmt.Sprintf("F.timestamp<=%s", next(q.MaxTime)))
+	}
+	// entries are ordered by sort key and file id, cursor points to the last
+	// entry of previous page
+	col := column.Name
+	if q.Cursor != "" {
+		c, err := decodeCursor(q.Cursor)
+		if err != nil {
+			return "", nil, "", err
+		}
+		var val interface{} = c.Value
+		if key == "bytes" || key == "timestamp" {
+			val = c.Num
+		}
+		op := ">"
+		if order == "DESC" {
+			op = "<"
+		}
+		cond = append(cond, fmt.Sprintf("(%s%s%s OR (%s=%s AND F.id%s%s))", col, op, next(val), col, next(val), op, next(c.Id)))
+	}
+	stm := getSQL("query_files")
+	if len(cond) > 0 {
+		stm += fmt.Sprintf(" WHERE %s", strings.Join(cond, " AND "))
+	}
+	stm += fmt.Sprintf(" ORDER BY %s %s, F.id %s", col, order, order)
+	if q.Limit > 0 {
+		stm += fmt.Sprintf(" LIMIT %d", q.Limit)
+	}
+	// join checksums of selected files, rows of the same file are adjacent
+	stm = fmt.Sprintf("SELECT Q.*, C.type, C.hash FROM (%s) AS Q LEFT JOIN CHECKSUMS AS C ON C.fileid=Q.fid ORDER BY Q.%s %s, Q.fid %s", stm, column.Alias, order, order)
+	return stm, args, key, nil
+}
+
+// Query method passes catalog entries matching given query to given function
+// one by one, entries are not held in memory. It returns cursor of the next
+// page if query limit is reached.
+func (c *Catalog) Query(q CatalogQuery, fn func(CatalogEntry) error) (string, error) {
+	stm, vals, key, err := q.statement()
+	if err != nil {
+		return "", err
+	}
+	if utils.VERBOSE > 0 {
+		log.WithFields(log.Fields{
+			"Query": stm,
+			"Value": vals,
+		}).Println("Catalog query")
+	}
+	rows, err := DB.Query(stm, vals...)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	var rec CatalogEntry
+	var fid int64
+	count := 0
+	for rows.Next() {
+		var id int64
+		var entry CatalogEntry
+		var hashType, alg, sum sql.NullString
+		err := rows.Scan(&id, &entry.Dataset, &entry.Block, &entry.Lfn, &entry.Pfn, &entry.Bytes, &entry.Hash, &hashType, &entry.TransferTime, &entry.Timestamp, &alg, &sum)
+		if err != nil {
+			return "", err
+		}
+		if id != fid {
+			if fid != 0 {
+				if err := fn(rec); err != nil {
+					return "", err
+				}
+			}
+			entry.HashType = hashType.String
+			entry.HashType = entry.HashAlgorithm()
+			entry.Checksums = make(map[string]string)
+			rec, fid = entry, id
+			count++
+		}
+		if alg.Valid {
+			rec.Checksums[alg.String] = sum.String
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+	if fid == 0 {
+		return "", nil
+	}
+	if err := fn(rec); err != nil {
+		return "", err
+	}
+	if q.Limit > 0 && count == q.Limit {
+		return encodeCursor(key, fid, rec), nil
+	}
+	return "", nil
+}
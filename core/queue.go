@@ -0,0 +1,214 @@
+package core
+
+// transfer2go persistent request queue implementation
+// Copyright (c) 2017 - Valentin Kuznetsov <vkuznet@gmail.com>
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vkuznet/transfer2go/utils"
+)
+
+// Request states stored in agent DB
+const (
+	RequestQueued       = "queued"       // request is accepted and waits for a worker
+	RequestPaused       = "paused"       // request is paused for its delay interval
+	RequestTransferring = "transferring" // request is processed by a worker
+	RequestRetrying     = "retrying"     // request failed and is put on hold for a retry
+	RequestDone         = "done"         // request is completed
+	RequestFailed       = "failed"       // request exceeded number of retries and was discarded
+	RequestCancelled    = "cancelled"    // request was cancelled by the user
+)
+
+// RequestRecord represents transfer request along with its processing status
+type RequestRecord struct {
+	Id        int64           `json:"id"`        // request id
+	Status    string          `json:"status"`    // request status, e.g. queued
+	Attempts  int             `json:"attempts"`  // number of transfer attempts
+	Error     string          `json:"error"`     // last error of the request
+	Bytes     int64           `json:"bytes"`     // number of transferred bytes
+	Timestamp int64           `json:"timestamp"` // time stamp of last status change
+	Request   TransferRequest `json:"request"`   // transfer request itself
+}
+
+// String provides string representation of RequestRecord
+func (r *RequestRecord) String() string {
+	return fmt.Sprintf("<RequestRecord id=%d status=%s attempts=%d error=%s bytes=%d timestamp=%d request=%s>", r.Id, r.Status, r.Attempts, r.Error, r.Bytes, r.Timestamp, r.Request.String())
+}
+
+// Persist method stores transfer request in agent DB with given status, new
+// requests get their id assigned by the DB
+func (t *TransferRequest) Persist(status string) error {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	if t.Id == 0 {
+		t.Id, err = insertID(getSQL("insert_requests"), string(data), status, time.Now().Unix())
+		return err
+	}
+	_, err = DB.Exec(getSQL("update_requests"), string(data), status, time.Now().Unix(), t.Id)
+	return err
+}
+
+// Requests returns list of request records for given id and status, empty
+// values match all requests
+func Requests(rid int64, status ...string) ([]RequestRecord, error) {
+	var out []RequestRecord
+	stm := getSQL("requests")
+	var cond []string
+	var vals []interface{}
+	if rid != 0 {
+		vals = append(vals, rid)
+		cond = append(cond, fmt.Sprintf("id=%s", placeholder(fmt.Sprintf("%d", len(vals)))))
+	}
+	if len(status) > 0 {
+		var sts []string
+		for _, s := range status {
+			vals = append(vals, s)
+			sts = append(sts, placeholder(fmt.Sprintf("%d", len(vals))))
+		}
+		cond = append(cond, fmt.Sprintf("status IN (%s)", strings.Join(sts, ",")))
+	}
+	if len(cond) > 0 {
+		stm += fmt.Sprintf(" WHERE %s", strings.Join(cond, " AND "))
+	}
+	stm += " ORDER BY id"
+
+	if utils.VERBOSE > 0 {
+		log.WithFields(log.Fields{
+			"Query": stm,
+			"Value": vals,
+		}).Println("Requests query")
+	}
+
+	rows, err := DB.Query(stm, vals...)
+	if err != nil {
+		return out, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var rec RequestRecord
+		var data string
+		err := rows.Scan(&rec.Id, &data, &rec.Status, &rec.Attempts, &rec.Error, &rec.Bytes, &rec.Timestamp)
+		if err != nil {
+			return out, err
+		}
+		err = json.Unmarshal([]byte(data), &rec.Request)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"Id":    rec.Id,
+				"Error": err,
+			}).Error("Unable to parse stored request")
+			continue
+		}
+		rec.Request.Id = rec.Id
+		out = append(out, rec)
+	}
+	return out, rows.Err()
+}
+
+// PendingRequests returns list of transfer requests stored in agent DB
+// which are not completed yet
+func PendingRequests() ([]TransferRequest, error) {
+	var out []TransferRequest
+	records, err := Requests(0, RequestQueued, RequestPaused, RequestTransferring, RequestRetrying)
+	if err != nil {
+		return out, err
+	}
+	for _, rec := range records {
+		if utils.VERBOSE > 0 {
+			log.WithFields(log.Fields{
+				"Request": rec.String(),
+			}).Println("Found stored request")
+		}
+		out = append(out, rec.Request)
+	}
+	return out, nil
+}
+
+// ReplayRequests puts all stored transfer requests back on JobQueue,
+// it should be called once the Dispatcher is running
+func ReplayRequests() {
+	requests, err := PendingRequests()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"Error": err,
+		}).Error("Unable to load stored requests")
+		return
+	}
+	log.WithFields(log.Fields{
+		"Requests": len(requests),
+	}).Println("Replay stored requests")
+	for _, t := range requests {
+		JobQueue <- Job{TransferRequest: t}
+	}
+}
+
+// SetStatus method changes status of transfer request in agent DB and records
+// given error as its last error, nil error keeps the last one
+func (t *TransferRequest) SetStatus(status string, e error) {
+	if t.Id == 0 {
+		return
+	}
+	var err error
+	if e != nil {
+		_, err = DB.Exec(getSQL("error_requests"), status, e.Error(), time.Now().Unix(), t.Id)
+	} else {
+		_, err = DB.Exec(getSQL("status_requests"), status, time.Now().Unix(), t.Id)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"Request": t.String(),
+			"Status":  status,
+			"Error":   err,
+		}).Error("Unable to update request status in DB")
+	}
+}
+
+// helper function to record new transfer attempt of the request
+func (t *TransferRequest) attempt() {
+	if t.Id == 0 {
+		return
+	}
+	_, err := DB.Exec(getSQL("attempt_requests"), RequestTransferring, time.Now().Unix(), t.Id)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"Request": t.String(),
+			"Error":   err,
+		}).Error("Unable to record request attempt in DB")
+	}
+}
+
+// helper function to account bytes moved by the request
+func (t *TransferRequest) addBytes(bytes int64) {
+	if t.Id == 0 {
+		return
+	}
+	_, err := DB.Exec(getSQL("bytes_requests"), bytes, time.Now().Unix(), t.Id)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"Request": t.String(),
+			"Error":   err,
+		}).Error("Unable to record request bytes in DB")
+	}
+}
+
+// helper function to keep request on hold in agent DB, errors are only
+// logged since request is still processed from the memory queue
+func (t *TransferRequest) hold(e error) {
+	_jobsMutex.Lock()
+	t.applyPriority()
+	_jobsMutex.Unlock()
+	if err := t.Persist(RequestRetrying); err != nil {
+		log.WithFields(log.Fields{
+			"Request": t.String(),
+			"Error":   err,
+		}).Error("Unable to put request on hold in DB")
+	}
+	t.SetStatus(RequestRetrying, e)
+}
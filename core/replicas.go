@@ -0,0 +1,211 @@
+package core
+
+// transfer2go replica index of blocks held by other agents
+// Copyright (c) 2017 - Valentin Kuznetsov <vkuznet@gmail.com>
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vkuznet/transfer2go/utils"
+)
+
+// Replica represents block of a dataset held by an agent
+type Replica struct {
+	Agent     string `json:"agent"`     // agent alias
+	Url       string `json:"url"`       // agent url
+	Dataset   string `json:"dataset"`   // dataset name
+	Block     string `json:"block"`     // block name
+	Files     int64  `json:"files"`     // number of files of the block held by the agent
+	Bytes     int64  `json:"bytes"`     // size of files of the block held by the agent
+	Timestamp int64  `json:"timestamp"` // time replica was last confirmed
+}
+
+// String provides string representation of Replica
+func (r *Replica) String() string {
+	return fmt.Sprintf("<Replica agent=%s url=%s dataset=%s block=%s files=%d bytes=%d timestamp=%d>", r.Agent, r.Url, r.Dataset, r.Block, r.Files, r.Bytes, r.Timestamp)
+}
+
+// ReplicaGossip represents update of replica index which agents periodically
+// send to each other. It carries all blocks held by sending agent, replicas
+// of other agents are not relayed since only the agent holding a block can
+// tell that the block was deleted.
+type ReplicaGossip struct {
+	Agent     string    `json:"agent"`     // alias of sending agent
+	Timestamp int64     `json:"timestamp"` // time blocks of sending agent were confirmed
+	Blocks    []Replica `json:"blocks"`    // blocks held by sending agent
+}
+
+// AddReplicas adds given replicas to replica index, known replicas are
+// updated unless index holds more recent confirmation of them
+func AddReplicas(replicas []Replica) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	for _, r := range replicas {
+		_, err := tx.Exec(getSQL("insert_replicas"), r.Agent, r.Url, r.Dataset, r.Block, r.Files, r.Bytes, r.Timestamp)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// RecordReplicas adds blocks of given catalog entries to replica index as
+// replicas of given agent, e.g. once files are transferred to the agent.
+// Counts of the entries are merged with replicas held by the index, they are
+// added to stored counts if entries complete previous transfer of the blocks
+// and replace stored counts only if they describe more files otherwise.
+func RecordReplicas(alias, aurl string, records []CatalogEntry, retry bool) error {
+	if alias == "" || len(records) == 0 {
+		return nil
+	}
+	now := time.Now().Unix()
+	var replicas []Replica
+	index := make(map[string]int)
+	for _, rec := range records {
+		idx, ok := index[rec.Block]
+		if !ok {
+			idx = len(replicas)
+			index[rec.Block] = idx
+			replicas = append(replicas, Replica{Agent: alias, Url: aurl, Dataset: rec.Dataset, Block: rec.Block, Timestamp: now})
+		}
+		replicas[idx].Files++
+		replicas[idx].Bytes += rec.Bytes
+	}
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	for _, r := range replicas {
+		var files, bytes int64
+		err := tx.QueryRow(getSQL("files_replicas"), r.Agent, r.Block).Scan(&files, &bytes)
+		if err != nil && err != sql.ErrNoRows {
+			tx.Rollback()
+			return err
+		}
+		if retry {
+			r.Files += files
+			r.Bytes += bytes
+		} else if files > r.Files {
+			r.Files, r.Bytes = files, bytes
+		}
+		_, err = tx.Exec(getSQL("insert_replicas"), r.Agent, r.Url, r.Dataset, r.Block, r.Files, r.Bytes, r.Timestamp)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// helper function to record replicas of given agent which holds given records
+// of transfer request. Only block and dataset requests are recorded since
+// records of a single file do not describe content of its block. Records of
+// retried request complete the ones of its previous attempts.
+func transferReplicas(t *TransferRequest, alias, aurl string, records []CatalogEntry) error {
+	if t.File != "" {
+		return nil
+	}
+	return RecordReplicas(alias, aurl, records, len(t.Failed) > 0)
+}
+
+// Replicas returns replicas from replica index which match given agent,
+// dataset and block, dataset and block may contain * wildcard
+func Replicas(agent, dataset, block string) ([]Replica, error) {
+	var out []Replica
+	var cond []string
+	var args sqlArgs
+	if agent != "" {
+		cond = append(cond, fmt.Sprintf("agent=%s", args.add(agent)))
+	}
+	if dataset != "" {
+		cond = append(cond, args.match("dataset", dataset))
+	}
+	if block != "" {
+		cond = append(cond, args.match("block", block))
+	}
+	stm := getSQL("replicas")
+	if len(cond) > 0 {
+		stm += fmt.Sprintf(" WHERE %s", strings.Join(cond, " AND "))
+	}
+	stm += " ORDER BY dataset, block, agent"
+	if utils.VERBOSE > 0 {
+		log.WithFields(log.Fields{
+			"Query": stm,
+			"Value": args,
+		}).Println("Replicas query")
+	}
+	rows, err := DB.Query(stm, args...)
+	if err != nil {
+		return out, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var r Replica
+		if err := rows.Scan(&r.Agent, &r.Url, &r.Dataset, &r.Block, &r.Files, &r.Bytes, &r.Timestamp); err != nil {
+			return out, err
+		}
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
+
+// Blocks method returns blocks of catalog entries matching given dataset and
+// block as replicas of given agent confirmed at the current time
+func (c *Catalog) Blocks(alias, aurl, dataset, block string) ([]Replica, error) {
+	var out []Replica
+	var cond []string
+	var args sqlArgs
+	if dataset != "" {
+		cond = append(cond, args.match("D.dataset", dataset))
+	}
+	if block != "" {
+		cond = append(cond, args.match("B.block", block))
+	}
+	stm := getSQL("blocks_files")
+	if len(cond) > 0 {
+		stm += fmt.Sprintf(" WHERE %s", strings.Join(cond, " AND "))
+	}
+	stm += " GROUP BY D.dataset, B.block ORDER BY D.dataset, B.block"
+	rows, err := DB.Query(stm, args...)
+	if err != nil {
+		return out, err
+	}
+	defer rows.Close()
+	now := time.Now().Unix()
+	for rows.Next() {
+		r := Replica{Agent: alias, Url: aurl, Timestamp: now}
+		if err := rows.Scan(&r.Dataset, &r.Block, &r.Files, &r.Bytes); err != nil {
+			return out, err
+		}
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
+
+// Apply method updates replica index with given gossip received by agent of
+// given alias, replicas of sending agent which are not among its blocks are
+// removed from the index. Gossip of the agent itself is rejected since its
+// TFC is authoritative for its blocks.
+func (g *ReplicaGossip) Apply(alias string) error {
+	if g.Agent == alias {
+		return fmt.Errorf("gossip of agent %s itself", alias)
+	}
+	var replicas []Replica
+	for _, r := range g.Blocks {
+		r.Agent = g.Agent
+		r.Timestamp = g.Timestamp
+		replicas = append(replicas, r)
+	}
+	if err := AddReplicas(replicas); err != nil {
+		return err
+	}
+	_, err := DB.Exec(getSQL("expire_replicas"), g.Agent, g.Timestamp)
+	return err
+}
@@ -4,15 +4,14 @@ package core
 // Copyright (c) 2017 - Valentin Kuznetsov <vkuznet@gmail.com>
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
 	"mime/multipart"
 	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -21,17 +20,21 @@ import (
 
 // AgentStatus data type
 type AgentStatus struct {
-	Url       string            `json:"url"`      // agent url
-	Name      string            `json:"name"`     // agent name or alias
-	TimeStamp int64             `json:"ts"`       // time stamp
-	Catalog   string            `json:"catalog"`  // underlying TFC catalog
-	Protocol  string            `json:"protocol"` // underlying transfer protocol
-	Backend   string            `json:"backend"`  // underlying transfer backend
-	Tool      string            `json:"tool"`     // underlying transfer tool, e.g. xrdcp
-	ToolOpts  string            `json:"toolopts"` // options for backend tool
-	Agents    map[string]string `json:"agents"`   // list of known agents
-	Addrs     []string          `json:"addrs"`    // list of all IP addresses
-	Metrics   map[string]int64  `json:"metrics"`  // agent metrics
+	Url       string            `json:"url"`       // agent url
+	Name      string            `json:"name"`      // agent name or alias
+	TimeStamp int64             `json:"ts"`        // time stamp
+	Catalog   string            `json:"catalog"`   // underlying TFC catalog
+	Protocol  string            `json:"protocol"`  // underlying transfer protocol
+	Backend   string            `json:"backend"`   // underlying transfer backend
+	Tool      string            `json:"tool"`      // underlying transfer tool, e.g. xrdcp
+	ToolOpts  string            `json:"toolopts"`  // options for backend tool
+	Streams   int               `json:"streams"`   // number of concurrent upload streams
+	Mode      string            `json:"mode"`      // transfer mode used to deliver files to this agent
+	Checksums []string          `json:"checksums"` // checksum algorithms computed for received files
+	Agents    map[string]string `json:"agents"`    // list of known agents
+	Addrs     []string          `json:"addrs"`     // list of all IP addresses
+	Metrics   map[string]int64  `json:"metrics"`   // agent metrics
+	Rules     PfnRules          `json:"rules"`     // LFN to PFN mapping rules of agent TFC
 }
 
 // Processor is an object who process' given task
@@ -57,7 +60,7 @@ var DefaultProcessor = &Processor{}
 
 // String provides string representation of given agent status
 func (a *AgentStatus) String() string {
-	return fmt.Sprintf("<Agent name=%s url=%s catalog=%s protocol=%s backend=%s tool=%s toolOpts=%s agents=%v addrs=%v metrics(%v)>", a.Name, a.Url, a.Catalog, a.Protocol, a.Backend, a.Tool, a.ToolOpts, a.Agents, a.Addrs, a.Metrics)
+	return fmt.Sprintf("<Agent name=%s url=%s catalog=%s protocol=%s backend=%s tool=%s toolOpts=%s streams=%d mode=%s checksums=%v rules=%v agents=%v addrs=%v metrics(%v)>", a.Name, a.Url, a.Catalog, a.Protocol, a.Backend, a.Tool, a.ToolOpts, a.Streams, a.Mode, a.Checksums, a.Rules, a.Agents, a.Addrs, a.Metrics)
 }
 
 // Process defines execution process for a given task
@@ -70,55 +73,214 @@ func (f RequestFunc) Process(t *TransferRequest) error {
 	return f(t)
 }
 
-// filleTransferRequest creates HTTP request to transfer a given file name
+// fileTransferRequest creates HTTP request to transfer a given file name,
+// the file is streamed from disk into request body through a pipe, therefore
+// memory usage does not depend on file size
 // https://matt.aimonetti.net/posts/2013/07/01/golang-multipart-file-upload-example/
 func fileTransferRequest(c CatalogEntry, tr *TransferRequest) (*http.Request, error) {
 	file, err := os.Open(c.Pfn)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
-	body := &bytes.Buffer{}
-	writer := multipart.NewWriter(body)
-	part, err := writer.CreateFormFile("data", filepath.Base(c.Pfn))
-	if err != nil {
-		return nil, err
-	}
-	_, err = io.Copy(part, file)
-	err = writer.Close()
+	pr, pw := io.Pipe()
+	writer := multipart.NewWriter(pw)
+	go func() {
+		// the pipe is closed by HTTP client once request is done, which
+		// will stop this writer even if remote end stopped reading our data
+		defer file.Close()
+		part, err := writer.CreateFormFile("data", filepath.Base(c.Pfn))
+		if err == nil {
+			_, err = io.Copy(part, file)
+		}
+		if err == nil {
+			err = writer.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	url := fmt.Sprintf("%s/upload", tr.DstUrl)
+	req, err := http.NewRequest("POST", url, pr)
 	if err != nil {
+		pr.CloseWithError(err)
 		return nil, err
 	}
-
-	url := fmt.Sprintf("%s/upload", tr.DstUrl)
-	req, err := http.NewRequest("POST", url, body)
 	req.Header.Set("Content-Type", writer.FormDataContentType())
 	req.Header.Set("Pfn", c.Pfn)
 	req.Header.Set("Lfn", c.Lfn)
 	req.Header.Set("Bytes", fmt.Sprintf("%d", c.Bytes))
-	req.Header.Set("Hash", c.Hash)
+	setChecksumHeaders(req.Header, c)
 	req.Header.Set("Src", tr.SrcAlias)
 	req.Header.Set("Dst", tr.DstAlias)
-	return req, err
+	return req, nil
 }
 
-// helper function to perform transfer via HTTP protocol
-func httpTransfer(c CatalogEntry, t *TransferRequest) (string, error) {
+// helper function to perform transfer via HTTP protocol, large files are
+// transferred in chunks within given number of streams which allows to
+// resume their transfer. It returns catalog entry of the file on destination.
+func httpTransfer(c CatalogEntry, t *TransferRequest, streams int) (CatalogEntry, error) {
+	var r CatalogEntry
+	if ChunkSize > 0 && c.Bytes > ChunkSize {
+		return chunkedTransfer(c, t, streams)
+	}
 	// create file transfer request
 	request, err := fileTransferRequest(c, t)
 	if err != nil {
-		return "", err
+		return r, err
 	}
 	client := utils.HttpClient()
 	resp, err := client.Do(request)
+	if err != nil {
+		return r, err
+	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return r, fmt.Errorf("upload of %s failed, status %s", c.Lfn, resp.Status)
+	}
 
-	var r CatalogEntry
 	err = json.NewDecoder(resp.Body).Decode(&r)
-	if err != nil {
-		return "", err
+	return r, err
+}
+
+// helper function to negotiate number of streams used to upload a file,
+// we use as many streams as both agents support
+func negotiateStreams(srcAgent, dstAgent AgentStatus) int {
+	streams := srcAgent.Streams
+	if dstAgent.Streams < streams {
+		streams = dstAgent.Streams
+	}
+	if streams < 1 {
+		streams = 1
+	}
+	return streams
+}
+
+// transferFunc represents Put or Get method of the backend
+type transferFunc func(c CatalogEntry, t *TransferRequest, srcAgent, dstAgent AgentStatus) (CatalogEntry, error)
+
+// TransferError reports files of transfer request which failed to transfer
+type TransferError struct {
+	Total  int      // number of files of the transfer
+	Lfns   []string // LFNs of failed files
+	Errors []string // errors of failed files
+}
+
+// Error returns description of failed files, only first ten are listed
+func (e *TransferError) Error() string {
+	msg := e.Errors
+	if len(msg) > 10 {
+		msg = append(msg[:10:10], "...")
+	}
+	return fmt.Sprintf("%d of %d files failed: %s", len(e.Lfns), e.Total, strings.Join(msg, "; "))
+}
+
+// helper function to record failed file
+func (e *TransferError) add(lfn string, err interface{}) {
+	e.Lfns = append(e.Lfns, lfn)
+	e.Errors = append(e.Errors, fmt.Sprintf("%s: %v", lfn, err))
+}
+
+// helper function to merge failed files of another TransferError
+func (e *TransferError) merge(err error) {
+	if te, ok := err.(*TransferError); ok {
+		e.Lfns = append(e.Lfns, te.Lfns...)
+		e.Errors = append(e.Errors, te.Errors...)
+	}
+}
+
+// helper function to return error if any file failed
+func (e *TransferError) failed() error {
+	if len(e.Lfns) == 0 {
+		return nil
+	}
+	return e
+}
+
+// helper function to fetch status of the agent with given url
+func agentStatus(aurl string) (AgentStatus, error) {
+	var agent AgentStatus
+	resp := utils.FetchResponse(fmt.Sprintf("%s/status", aurl), []byte{})
+	if resp.Error != nil {
+		return agent, resp.Error
+	}
+	err := json.Unmarshal(resp.Data, &agent)
+	return agent, err
+}
+
+// helper function to construct catalog entry of transferred record from its
+// source entry and entry reported by destination
+func transferredEntry(rec, entry CatalogEntry, time0 int64) CatalogEntry {
+	r := CatalogEntry{Dataset: rec.Dataset, Block: rec.Block, Lfn: rec.Lfn, Pfn: entry.Pfn, Bytes: rec.Bytes, Hash: rec.Hash, HashType: rec.HashAlgorithm(), TransferTime: (time.Now().Unix() - time0), Timestamp: time.Now().Unix()}
+	sums := rec.AllChecksums()
+	for alg, sum := range entry.Checksums {
+		sums[alg] = sum
+	}
+	r.Checksums = sums
+	return r
+}
+
+// helper function to transfer records one by one with given backend method,
+// it returns list of successfully transferred records and TransferError if
+// any record failed
+func fileTransfers(transfer transferFunc, records []CatalogEntry, t *TransferRequest, srcAgent, dstAgent AgentStatus) ([]CatalogEntry, error) {
+	var trRecords []CatalogEntry // list of successfully transferred records
+	failed := &TransferError{Total: len(records)}
+	for _, rec := range records {
+
+		time0 := time.Now().Unix()
+
+		AgentMetrics.Bytes.Inc(rec.Bytes)
+
+		entry, err := transfer(rec, t, srcAgent, dstAgent) // entry on destination
+		if err != nil {
+			log.WithFields(log.Fields{
+				"TransferRequest": t.String(),
+				"Record":          rec.String(),
+				"Err":             err,
+			}).Error("Transfer", rec.String(), t.String(), err)
+			AgentMetrics.Bytes.Dec(rec.Bytes)
+			failed.add(rec.Lfn, err)
+			continue // if we fail on single record we continue with others
+		}
+		r := transferredEntry(rec, entry, time0)
+		trRecords = append(trRecords, r)
+
+		// record how much we transferred
+		AgentMetrics.TotalBytes.Inc(r.Bytes) // keep growing
+		AgentMetrics.Total.Inc(1)            // keep growing
+		AgentMetrics.Bytes.Dec(rec.Bytes)    // decrement since we're done
+		t.addBytes(r.Bytes)
+
+	}
+	return trRecords, failed.failed()
+}
+
+// helper function to select records transferred by current attempt of the
+// request, retries transfer only files which failed in previous attempt
+func (t *TransferRequest) pending(records []CatalogEntry) []CatalogEntry {
+	if len(t.Failed) == 0 {
+		return records
+	}
+	failed := make(map[string]bool)
+	for _, lfn := range t.Failed {
+		failed[lfn] = true
+	}
+	var out []CatalogEntry
+	for _, rec := range records {
+		if failed[rec.Lfn] {
+			out = append(out, rec)
+		}
+	}
+	return out
+}
+
+// helper function to remember files which failed in current attempt of the
+// request, other errors keep the files of the attempt for the next one
+func (t *TransferRequest) setFailed(err error) {
+	if err == nil {
+		t.Failed = nil
+	} else if e, ok := err.(*TransferError); ok {
+		t.Failed = e.Lfns
 	}
-	return r.Pfn, nil
 }
 
 // Transfer returns a Decorator that performs request transfers
@@ -128,7 +290,20 @@ func Transfer() Decorator {
 			log.WithFields(log.Fields{
 				"Request": t.String(),
 			}).Println("Request Transfer", t.String())
-			records := TFC.Records(*t)
+			if t.cancelled() {
+				return ErrRequestCancelled
+			}
+			t.attempt()
+			if t.Mode == PullMode {
+				// destination agent fetches files from the source one
+				err := pullTransfer(t)
+				t.setFailed(err)
+				if err != nil {
+					return err
+				}
+				return r.Process(t)
+			}
+			records := t.pending(TFC.Records(*t))
 			if len(records) == 0 {
 				// file does not exists in TFC, nothing to do, return immediately
 				log.WithFields(log.Fields{
@@ -137,95 +312,52 @@ func Transfer() Decorator {
 				return r.Process(t)
 			}
 			// obtain information about source and destination agents
-			url := fmt.Sprintf("%s/status", t.DstUrl)
-			resp := utils.FetchResponse(url, []byte{})
-			if resp.Error != nil {
-				return resp.Error
-			}
-			var dstAgent AgentStatus
-			err := json.Unmarshal(resp.Data, &dstAgent)
+			dstAgent, err := agentStatus(t.DstUrl)
 			if err != nil {
 				return err
 			}
-			url = fmt.Sprintf("%s/status", t.SrcUrl)
-			resp = utils.FetchResponse(url, []byte{})
-			if resp.Error != nil {
-				return resp.Error
-			}
-			var srcAgent AgentStatus
-			err = json.Unmarshal(resp.Data, &srcAgent)
+			srcAgent, err := agentStatus(t.SrcUrl)
 			if err != nil {
 				return err
 			}
 
-			// TODO: I need to implement bulk transfer for all files in found records
-			// so far I loop over them individually and transfer one by one
+			// transfer records with the backend of source agent protocol, failed
+			// records are reported by TransferError
 			var trRecords []CatalogEntry // list of successfully transferred records
-			for _, rec := range records {
-
-				time0 := time.Now().Unix()
-
-				AgentMetrics.Bytes.Inc(rec.Bytes)
-
-				// if protocol is not given use default one: HTTP
-				var rpfn string // remote PFN
-				if srcAgent.Protocol == "" || srcAgent.Protocol == "http" {
-					log.WithFields(log.Fields{
-						"dstAgent": dstAgent.String(),
-					}).Println("Transfer via HTTP protocol to", dstAgent.String())
-					rpfn, err = httpTransfer(rec, t)
-					if err != nil {
-						log.WithFields(log.Fields{
-							"TransferRequest": t.String(),
-							"Record":          rec.String(),
-							"Err":             err,
-						}).Error("Transfer", rec.String(), t.String(), err)
-						continue // if we fail on single record we continue with others
-					}
-				} else {
-					// construct remote PFN by using destination agent backend and record LFN
-					rpfn = fmt.Sprintf("%s%s", dstAgent.Backend, rec.Lfn)
-					// perform transfer with the help of backend tool
-					var cmd *exec.Cmd
-					if srcAgent.ToolOpts == "" {
-						cmd = exec.Command(srcAgent.Tool, rec.Pfn, rpfn)
-					} else{
-						cmd = exec.Command(srcAgent.Tool, srcAgent.ToolOpts, rec.Pfn, rpfn)
-					}
-					log.WithFields(log.Fields{
-						"Command": cmd,
-					}).Println("Transfer command")
-					err = cmd.Run()
-					if err != nil {
-						log.WithFields(log.Fields{
-							"Tool":         srcAgent.Tool,
-							"Tool options": srcAgent.ToolOpts,
-							"PFN":          rec.Pfn,
-							"Remote PFN":   rpfn,
-							"Err":          err,
-						}).Error("Transfer")
-						continue // if we fail on single record we continue with others
-					}
-				}
-				r := CatalogEntry{Dataset: rec.Dataset, Block: rec.Block, Lfn: rec.Lfn, Pfn: rpfn, Bytes: rec.Bytes, Hash: rec.Hash, TransferTime: (time.Now().Unix() - time0), Timestamp: time.Now().Unix()}
-				trRecords = append(trRecords, r)
-
-				// record how much we transferred
-				AgentMetrics.TotalBytes.Inc(r.Bytes) // keep growing
-				AgentMetrics.Total.Inc(1)            // keep growing
-				AgentMetrics.Bytes.Dec(rec.Bytes)    // decrement since we're done
-
+			backend := GetBackend(srcAgent.Protocol)
+			if bulk, ok := backend.(BulkBackend); ok && BulkSize > 1 && len(records) > 1 {
+				trRecords, err = bulk.PutMany(records, t, srcAgent, dstAgent)
+			} else {
+				trRecords, err = fileTransfers(backend.Put, records, t, srcAgent, dstAgent)
+			}
+			if len(trRecords) == 0 {
+				t.setFailed(err)
+				return err
 			}
 			// Add entry for remote TFC after transfer is completed
-			url = fmt.Sprintf("%s/tfc", t.DstUrl)
+			url := fmt.Sprintf("%s/tfc", t.DstUrl)
 			d, e := json.Marshal(trRecords)
 			if e != nil {
 				return e
 			}
-			resp = utils.FetchResponse(url, d) // POST request
+			resp := utils.FetchResponse(url, d) // POST request
 			if resp.Error != nil {
 				return resp.Error
 			}
+			if resp.StatusCode != http.StatusOK {
+				return fmt.Errorf("unable to register transferred files at %s, %s %s", t.DstUrl, resp.Status, string(resp.Data))
+			}
+			if err := transferReplicas(t, t.DstAlias, t.DstUrl, trRecords); err != nil {
+				log.WithFields(log.Fields{
+					"TransferRequest": t.String(),
+					"Error":           err,
+				}).Error("Unable to record replicas of destination agent")
+			}
+			// retry files which failed, registered ones are not transferred again
+			t.setFailed(err)
+			if err != nil {
+				return err
+			}
 
 			return r.Process(t)
 		})
@@ -251,7 +383,11 @@ func Pause(interval time.Duration) Decorator {
 					"Request":  t,
 					"Interval": interval,
 				}).Println("TransferRequest is paused by")
+				t.SetStatus(RequestPaused, nil)
 				time.Sleep(interval)
+				if t.cancelled() {
+					return ErrRequestCancelled
+				}
 			}
 			return r.Process(t)
 		})
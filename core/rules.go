@@ -0,0 +1,148 @@
+package core
+
+// transfer2go LFN to PFN mapping rules of Trivial File Catalog
+// Copyright (c) 2017 - Valentin Kuznetsov <vkuznet@gmail.com>
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/vkuznet/transfer2go/utils"
+)
+
+// PfnRule defines LFN to PFN mapping rule of given protocol, similar to
+// lfn-to-pfn rules of PhEDEx storage.xml. If LFN matches PathMatch regular
+// expression it is replaced by Result which can refer to sub-matches, e.g. $1.
+// Rule with Chain is applied to the result of rules of chained protocol.
+type PfnRule struct {
+	Protocol  string `json:"protocol"`   // transfer protocol, e.g. http, posix
+	PathMatch string `json:"path-match"` // regular expression matching LFN
+	Result    string `json:"result"`     // resulting PFN, e.g. /data/store/$1
+	Chain     string `json:"chain"`      // protocol whose rules are applied first
+}
+
+// String provides string representation of PfnRule
+func (r *PfnRule) String() string {
+	return fmt.Sprintf("<PfnRule protocol=%s path-match=%s result=%s chain=%s>", r.Protocol, r.PathMatch, r.Result, r.Chain)
+}
+
+// PfnRules represents ordered list of mapping rules, first matching rule of
+// a protocol is used
+type PfnRules []PfnRule
+
+// Validate checks that all rules define protocol and valid regular expression
+// and that rules do not chain protocols in a loop
+func (rules PfnRules) Validate() error {
+	for _, r := range rules {
+		if r.Protocol == "" {
+			return fmt.Errorf("rule does not define protocol, %s", r.String())
+		}
+		if _, err := regexp.Compile(r.PathMatch); err != nil {
+			return fmt.Errorf("invalid path-match of %s, %v", r.String(), err)
+		}
+		if err := rules.checkChain(r.Protocol, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// helper function to check that chained rules of given protocol do not refer
+// to protocols of chain we're in
+func (rules PfnRules) checkChain(protocol string, visited []string) error {
+	if utils.InList(protocol, visited) {
+		return fmt.Errorf("rules of protocol %s chain in a loop", protocol)
+	}
+	visited = append(visited, protocol)
+	for _, r := range rules {
+		if r.Protocol == protocol && r.Chain != "" {
+			if err := rules.checkChain(r.Chain, visited); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// LfnToPfn maps given LFN to PFN by using rules of given protocol, relative
+// PFNs are placed within backend directory and PFNs outside of it are
+// rejected. It returns empty PFN if no rule of the protocol matches LFN.
+func (rules PfnRules) LfnToPfn(protocol, lfn, backend string) (string, error) {
+	pfn, err := rules.lfnToPfn(protocol, lfn, nil)
+	if err != nil || pfn == "" || strings.Contains(pfn, "://") {
+		return pfn, err
+	}
+	if !filepath.IsAbs(pfn) {
+		pfn = filepath.Join(backend, pfn)
+	}
+	if backend != "" && !withinDir(backend, pfn) {
+		return "", fmt.Errorf("PFN %s of LFN %s is outside of backend %s", pfn, lfn, backend)
+	}
+	return pfn, nil
+}
+
+// helper function to check that cleaned path is located under given directory
+func withinDir(dir, path string) bool {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// helper function to apply rules of given protocol, visited holds protocols
+// of chain we're in
+func (rules PfnRules) lfnToPfn(protocol, lfn string, visited []string) (string, error) {
+	if protocol == "" {
+		protocol = "http"
+	}
+	if utils.InList(protocol, visited) {
+		return "", fmt.Errorf("rules of protocol %s chain in a loop", protocol)
+	}
+	visited = append(visited, protocol)
+	for _, r := range rules {
+		if r.Protocol != protocol {
+			continue
+		}
+		path := lfn
+		if r.Chain != "" {
+			var err error
+			path, err = rules.lfnToPfn(r.Chain, lfn, visited)
+			if err != nil {
+				return "", err
+			}
+			if path == "" {
+				continue
+			}
+		}
+		re, err := regexp.Compile(r.PathMatch)
+		if err != nil {
+			return "", err
+		}
+		if re.MatchString(path) {
+			return re.ReplaceAllString(path, r.Result), nil
+		}
+	}
+	return "", nil
+}
+
+// BackendPfn returns PFN of given LFN within backend, LFNs which are not
+// mapped by rules of given protocol keep their directory structure under
+// backend directory
+func BackendPfn(rules PfnRules, protocol, lfn, backend string) (string, error) {
+	pfn, err := rules.LfnToPfn(protocol, lfn, backend)
+	if err != nil || pfn != "" {
+		return pfn, err
+	}
+	return filepath.Join(backend, filepath.Clean("/"+lfn)), nil
+}
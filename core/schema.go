@@ -0,0 +1,126 @@
+package core
+
+// transfer2go agent DB schema bootstrap and migrations
+// Copyright (c) 2017 - Valentin Kuznetsov <vkuznet@gmail.com>
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// migration represents versioned change of agent DB schema, its statements
+// are stored in migrate_<version>.sql file of DB type SQL area. Migrations
+// are never renumbered once released, new schema changes are added as new
+// versions. MySQL commits DDL statements implicitly, therefore interrupted
+// migration is applied again as a whole and its statements which already
+// took effect are tolerated.
+type migration struct {
+	Version int    // schema version the migration brings DB to
+	Key     string // SQL key of migration statements
+}
+
+// helper function to return migrations of agent DB type sorted by version
+func migrations() ([]migration, error) {
+	var out []migration
+	for key := range DBSQL {
+		if !strings.HasPrefix(key, "migrate_") {
+			continue
+		}
+		version, err := strconv.Atoi(strings.TrimPrefix(key, "migrate_"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration %s", key)
+		}
+		out = append(out, migration{Version: version, Key: key})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Version < out[j].Version })
+	return out, nil
+}
+
+// helper function to split SQL of migration into statements
+func statements(stm string) []string {
+	var out []string
+	for _, s := range strings.Split(stm, ";") {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// helper function to check whether error of migration statement reports that
+// its change already exists, e.g. column of catalogs created before schema
+// versioning or index created by interrupted MySQL migration
+func appliedStatement(err error) bool {
+	msg := strings.ToLower(err.Error())
+	for _, s := range []string{"duplicate column", "duplicate key name", "already exists"} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// helper function to apply migration to agent DB, migration statements and
+// new schema version are committed in single transaction
+func (m migration) apply() error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	for _, stm := range statements(getSQL(m.Key)) {
+		if _, err := tx.Exec(stm); err != nil {
+			if appliedStatement(err) {
+				continue
+			}
+			tx.Rollback()
+			return err
+		}
+	}
+	if _, err := tx.Exec(getSQL("insert_schema_version"), m.Version, time.Now().Unix()); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// SchemaVersion returns schema version of agent DB, zero version means that
+// no schema is created yet
+func SchemaVersion() (int, error) {
+	var version sql.NullInt64
+	err := DB.QueryRow(getSQL("schema_version")).Scan(&version)
+	return int(version.Int64), err
+}
+
+// InitSchema creates schema of agent DB on first start and applies migrations
+// which are newer than DB schema version on upgrade
+func InitSchema() error {
+	if _, err := DB.Exec(getSQL("create_schema_version")); err != nil {
+		return err
+	}
+	version, err := SchemaVersion()
+	if err != nil {
+		return err
+	}
+	list, err := migrations()
+	if err != nil {
+		return err
+	}
+	for _, m := range list {
+		if m.Version <= version {
+			continue
+		}
+		if err := m.apply(); err != nil {
+			return fmt.Errorf("unable to migrate DB schema to version %d, %v", m.Version, err)
+		}
+		log.WithFields(log.Fields{
+			"Version": m.Version,
+		}).Info("Migrated DB schema")
+	}
+	return nil
+}
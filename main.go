@@ -10,9 +10,12 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"runtime"
+	"strings"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/vkuznet/transfer2go/client"
+	"github.com/vkuznet/transfer2go/core"
 	"github.com/vkuznet/transfer2go/server"
 	"github.com/vkuznet/transfer2go/utils"
 )
@@ -32,8 +35,26 @@ func main() {
 	flag.StringVar(&src, "src", "", "Source end-point, either local file or AgentName:LFN")
 	var dst string
 	flag.StringVar(&dst, "dst", "", "Destination end-point, either AgentName or AgentName:LFN")
+	var priority int
+	flag.IntVar(&priority, "priority", 0, "Priority of transfer request, requests with higher priority are transferred first")
+	var mode string
+	flag.StringVar(&mode, "mode", "", "Transfer mode, push or pull, by default the mode of destination agent is used")
 	var register string
 	flag.StringVar(&register, "register", "", "File with meta-data of records in JSON data format to register at remote agent")
+	var importFile string
+	flag.StringVar(&importFile, "import", "", "File with catalog entries exported by /tfc/export API, in JSON lines or CSV (.csv extension) format, to import at remote agent")
+	var checksums string
+	flag.StringVar(&checksums, "checksums", "", "Comma separated list of checksum algorithms computed for registered files, the first one is used as file hash, e.g. adler32,sha256")
+	var scan string
+	flag.StringVar(&scan, "scan", "", "Local directory to scan for files which are registered at remote agent")
+	var rule string
+	flag.StringVar(&rule, "rule", "", "File with scan rule in JSON data format which derives lfn, dataset and block from relative file path, by default dataset is named after scanned directory")
+	var batch int
+	flag.IntVar(&batch, "batch", 1000, "Number of records registered at remote agent within single request")
+	var hashers int
+	flag.IntVar(&hashers, "hashers", runtime.NumCPU(), "Number of files hashed concurrently during registration")
+	var trust bool
+	flag.BoolVar(&trust, "trust", false, "Trust hash and bytes of records provided in registration meta-data instead of computing them")
 
 	var authVar bool
 	flag.BoolVar(&authVar, "auth", true, "To disable the auth layer")
@@ -72,12 +93,30 @@ func main() {
 		if config.QueueSize == 0 {
 			config.QueueSize = 100 // default value
 		}
+		if config.BulkSize == 0 {
+			config.BulkSize = 100 // default value
+		}
+		if config.ChunkSize == 0 {
+			config.ChunkSize = 64 * 1024 * 1024 // default value, 64MB
+		}
+		if config.Streams == 0 {
+			config.Streams = 1 // default value
+		}
 		if config.Protocol == "" {
 			config.Protocol = "http" // default value
 		}
+		if config.Mode == "" {
+			config.Mode = core.PushMode // default value
+		}
+		if len(config.Checksums) == 0 {
+			config.Checksums = []string{utils.DefaultChecksum} // default value
+		}
 		if config.Port == 0 {
 			config.Port = 8989
 		}
+		if config.Ginterval == 0 {
+			config.Ginterval = 300 // default value
+		}
 		if agent != "" {
 			config.Register = agent
 		}
@@ -89,12 +128,23 @@ func main() {
 		server.Server(config)
 	} else {
 		var err error
+		var algs []string
+		for _, alg := range strings.Split(checksums, ",") {
+			if alg = strings.TrimSpace(alg); alg != "" {
+				algs = append(algs, alg)
+			}
+		}
+		client.BatchSize = batch
 		if register != "" {
-			err = client.Register(agent, register)
+			err = client.Register(agent, register, algs, hashers, trust)
+		} else if importFile != "" {
+			err = client.Import(agent, importFile)
+		} else if scan != "" {
+			err = client.Scan(agent, scan, rule, algs, hashers)
 		} else if src == "" { // no transfer request
 			client.Agent(agent)
 		} else {
-			err = client.Transfer(agent, src, dst)
+			err = client.Transfer(agent, src, dst, mode, priority)
 		}
 		if err != nil {
 			log.Fatal(err)
@@ -13,7 +13,9 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -117,14 +119,28 @@ func AuthHandler(w http.ResponseWriter, r *http.Request) {
 		StatusHandler(w, r)
 	case "agents":
 		AgentsHandler(w, r)
+	case "transfers":
+		TransfersHandler(w, r)
 	case "files":
 		FilesHandler(w, r)
 	case "reset":
 		ResetHandler(w, r)
 	case "tfc":
 		TFCHandler(w, r)
+	case "export":
+		TFCExportHandler(w, r)
+	case "consistency":
+		ConsistencyHandler(w, r)
+	case "replicas":
+		ReplicasHandler(w, r)
 	case "upload":
 		UploadDataHandler(w, r)
+	case "bulkupload":
+		BulkUploadHandler(w, r)
+	case "chunk":
+		ChunkUploadHandler(w, r)
+	case "download":
+		DownloadHandler(w, r)
 	case "request":
 		RequestHandler(w, r)
 	case "register":
@@ -193,7 +209,7 @@ func StatusHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	addrs := utils.HostIP()
-	astats := core.AgentStatus{Addrs: addrs, Catalog: core.TFC.Type, Name: _alias, Url: _myself, Protocol: _protocol, Backend: _backend, Tool: _tool, ToolOpts: _toolOpts, Agents: _agents, TimeStamp: time.Now().Unix(), Metrics: core.AgentMetrics.ToDict()}
+	astats := core.AgentStatus{Addrs: addrs, Catalog: core.TFC.Type, Name: _alias, Url: _myself, Protocol: _protocol, Backend: _backend, Tool: _tool, ToolOpts: _toolOpts, Streams: core.Streams, Mode: _mode, Checksums: core.Checksums, Rules: core.TFC.Rules, Agents: _agents, TimeStamp: time.Now().Unix(), Metrics: core.AgentMetrics.ToDict()}
 	data, err := json.Marshal(astats)
 	if err != nil {
 		log.WithFields(log.Fields{
@@ -257,25 +273,18 @@ func ResetHandler(w http.ResponseWriter, r *http.Request) {
 // TFCHandler registers given record in local TFC
 func TFCHandler(w http.ResponseWriter, r *http.Request) {
 
-	if !(r.Method == "POST" || r.Method == "GET") {
+	if !(r.Method == "POST" || r.Method == "GET" || r.Method == "DELETE") {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
 	defer r.Body.Close()
 
 	if r.Method == "GET" {
-		records := core.TFC.Records(core.TransferRequest{})
-		data, err := json.Marshal(records)
-		if err != nil {
-			log.WithFields(log.Fields{
-				"Records": records,
-				"Error":   err,
-			}).Error("TFCHandler unable to marshal", records, err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		w.WriteHeader(http.StatusOK)
-		w.Write(data)
+		queryRecords(w, r)
+		return
+	}
+	if r.Method == "DELETE" {
+		deleteRecords(w, r)
 		return
 	}
 	var records []core.CatalogEntry
@@ -285,17 +294,351 @@ func TFCHandler(w http.ResponseWriter, r *http.Request) {
 			"Request Body": r.Body,
 			"Error":        err,
 		}).Error("TFCHandler unable to decode", r.Body, err)
-		w.WriteHeader(http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 	for _, rec := range records {
-		err = core.TFC.Add(rec)
+		if err := rec.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	err = core.TFC.AddMany(records)
+	if err != nil {
 		log.WithFields(log.Fields{
-			"Record": rec.String(),
-			"Error":  err,
-		}).Println("TFCHandler adds")
+			"Records": len(records),
+			"Error":   err,
+		}).Error("TFCHandler unable to add records")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.WithFields(log.Fields{
+		"Records": len(records),
+	}).Println("TFCHandler adds")
+	w.WriteHeader(http.StatusOK)
+}
+
+// TFCExportHandler exports catalog entries matching lfn, block, dataset,
+// size and timestamp parameters in JSON lines (default) or CSV format given
+// by format parameter
+func TFCExportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	format := r.FormValue("format")
+	if format == "" {
+		format = core.ExportJSON
+	}
+	var ctype string
+	switch format {
+	case core.ExportJSON:
+		ctype = "application/x-ndjson"
+	case core.ExportCSV:
+		ctype = "text/csv"
+	default:
+		http.Error(w, fmt.Sprintf("unsupported export format %s", format), http.StatusBadRequest)
+		return
+	}
+	q, err := catalogQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", ctype)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=tfc.%s", format))
+	if err := core.TFC.Export(w, format, q); err != nil {
+		// entries may already be sent, we can only log the failure
+		log.WithFields(log.Fields{
+			"Query": q.String(),
+			"Error": err,
+		}).Error("TFCExportHandler unable to export records")
+	}
+}
+
+// helper data structure to report status of consistency check
+type consistencyStatus struct {
+	Running bool                    `json:"running"` // check is running
+	Report  *core.ConsistencyReport `json:"report"`  // report of running or last finished check
+}
+
+// ConsistencyHandler reports status of catalog consistency check on GET
+// request and starts new check on POST request. Check can be restricted to
+// catalog entries matching lfn, block, dataset, size and timestamp parameters,
+// in that case backend is not scanned for orphaned files, and quick parameter
+// restricts it to comparison of file sizes. If repair parameter is set
+// transfers of missing and corrupt files from replicas of other agents are
+// queued and their request ids are listed in the report.
+func ConsistencyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		running, report := core.ConsistencyStatus()
+		data, err := json.Marshal(consistencyStatus{Running: running, Report: report})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write(data)
+		return
+	}
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	q, err := catalogQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	quick, err := boolParam(r, "quick")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	repair, err := boolParam(r, "repair")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	q.Limit = 0
+	q.Cursor = ""
+	check := core.ConsistencyCheck{Protocol: _protocol, Query: q, Quick: quick, Repair: repairer(repair)}
+	if (q == core.CatalogQuery{Sort: q.Sort}) {
+		check.Dir = storageDir()
+	}
+	if !check.Start() {
+		http.Error(w, "consistency check is already running", http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// helper function to parse integer parameter of HTTP request, missing
+// parameter is zero
+func intParam(r *http.Request, key string) (int64, error) {
+	val := r.FormValue(key)
+	if val == "" {
+		return 0, nil
+	}
+	i, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s parameter, %v", key, err)
+	}
+	return i, nil
+}
+
+// helper function to construct catalog query from parameters of HTTP request
+func catalogQuery(r *http.Request) (core.CatalogQuery, error) {
+	q := core.CatalogQuery{Lfn: r.FormValue("lfn"), Block: r.FormValue("block"), Dataset: r.FormValue("dataset"), Sort: r.FormValue("sort"), Cursor: r.FormValue("cursor")}
+	var err error
+	if q.MinBytes, err = intParam(r, "minbytes"); err != nil {
+		return q, err
+	}
+	if q.MaxBytes, err = intParam(r, "maxbytes"); err != nil {
+		return q, err
+	}
+	if q.MinTime, err = intParam(r, "mintime"); err != nil {
+		return q, err
+	}
+	if q.MaxTime, err = intParam(r, "maxtime"); err != nil {
+		return q, err
+	}
+	limit, err := intParam(r, "limit")
+	if err != nil {
+		return q, err
+	}
+	q.Limit = int(limit)
+	return q, q.Validate()
+}
+
+// helper function to query catalog entries. Entries are written as JSON
+// array or, if format=ndjson parameter or application/x-ndjson Accept header
+// is given, as newline delimited JSON. Without limit parameter entries are
+// streamed as they are read from DB, otherwise page of entries is returned
+// along with Cursor header which refers to the next page.
+func queryRecords(w http.ResponseWriter, r *http.Request) {
+	q, err := catalogQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ndjson := r.FormValue("format") == "ndjson" || strings.Contains(r.Header.Get("Accept"), "application/x-ndjson")
+	if q.Limit > 0 {
+		var records []core.CatalogEntry
+		cursor, err := core.TFC.Query(q, func(rec core.CatalogEntry) error {
+			records = append(records, rec)
+			return nil
+		})
+		if err != nil {
+			log.WithFields(log.Fields{
+				"Query": q.String(),
+				"Error": err,
+			}).Error("TFCHandler unable to query records")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if cursor != "" {
+			w.Header().Set("Cursor", cursor)
+		}
+		enc := newRecordEncoder(w, ndjson)
+		for _, rec := range records {
+			enc.Encode(rec)
+		}
+		enc.Close()
+		return
+	}
+	var enc *recordEncoder
+	_, err = core.TFC.Query(q, func(rec core.CatalogEntry) error {
+		if enc == nil {
+			enc = newRecordEncoder(w, ndjson)
+		}
+		return enc.Encode(rec)
+	})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"Query": q.String(),
+			"Error": err,
+		}).Error("TFCHandler unable to query records")
+		if enc == nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	if enc == nil {
+		enc = newRecordEncoder(w, ndjson)
+	}
+	enc.Close()
+}
+
+// helper data structure to write catalog entries either as JSON array or as
+// newline delimited JSON
+type recordEncoder struct {
+	w      http.ResponseWriter
+	enc    *json.Encoder
+	ndjson bool
+	count  int
+}
+
+// helper function to create record encoder, it writes response header
+func newRecordEncoder(w http.ResponseWriter, ndjson bool) *recordEncoder {
+	if ndjson {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.WriteHeader(http.StatusOK)
+	return &recordEncoder{w: w, enc: json.NewEncoder(w), ndjson: ndjson}
+}
+
+// Encode writes given catalog entry and flushes it to the client
+func (e *recordEncoder) Encode(rec core.CatalogEntry) error {
+	if !e.ndjson {
+		sep := ","
+		if e.count == 0 {
+			sep = "["
+		}
+		if _, err := io.WriteString(e.w, sep); err != nil {
+			return err
+		}
+	}
+	e.count++
+	if err := e.enc.Encode(rec); err != nil {
+		return err
+	}
+	if f, ok := e.w.(http.Flusher); ok && e.count%1000 == 0 {
+		f.Flush()
+	}
+	return nil
+}
+
+// Close terminates JSON array of written entries
+func (e *recordEncoder) Close() {
+	if e.ndjson {
+		return
+	}
+	if e.count == 0 {
+		io.WriteString(e.w, "[")
+	}
+	io.WriteString(e.w, "]")
+}
+
+// helper function to parse boolean parameter of HTTP request, missing
+// parameter is false
+func boolParam(r *http.Request, key string) (bool, error) {
+	val := r.FormValue(key)
+	if val == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(val)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s parameter, %v", key, err)
+	}
+	return b, nil
+}
+
+// helper data structure to report removal of catalog entries
+type deletion struct {
+	DryRun bool                `json:"dryrun"`           // entries are only listed, not removed
+	Purge  bool                `json:"purge"`            // physical files are removed as well
+	Files  []core.CatalogEntry `json:"files"`            // removed catalog entries
+	Errors map[string]string   `json:"errors,omitempty"` // errors of physical file removal keyed by lfn
+}
+
+// helper function to remove catalog entries matching lfn, block or dataset
+// of HTTP request. Physical files are removed via agent backend if purge
+// parameter is set, dryrun parameter lists entries which would be removed.
+func deleteRecords(w http.ResponseWriter, r *http.Request) {
+	req := core.TransferRequest{File: r.FormValue("lfn"), Block: r.FormValue("block"), Dataset: r.FormValue("dataset")}
+	if req.File == "" && req.Block == "" && req.Dataset == "" {
+		http.Error(w, "lfn, block or dataset parameter is required", http.StatusBadRequest)
+		return
+	}
+	var out deletion
+	var err error
+	if out.DryRun, err = boolParam(r, "dryrun"); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if out.Purge, err = boolParam(r, "purge"); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if out.DryRun {
+		out.Files = core.TFC.Records(req)
+	} else {
+		out.Files, err = core.TFC.Delete(req)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"Request": req.String(),
+				"Error":   err,
+			}).Error("TFCHandler unable to delete records")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if out.Purge {
+			backend := core.GetBackend(_protocol)
+			for _, rec := range out.Files {
+				if err := backend.Delete(rec.Pfn); err != nil && !os.IsNotExist(err) {
+					if out.Errors == nil {
+						out.Errors = make(map[string]string)
+					}
+					out.Errors[rec.Lfn] = err.Error()
+					log.WithFields(log.Fields{
+						"LFN":   rec.Lfn,
+						"PFN":   rec.Pfn,
+						"Error": err,
+					}).Error("TFCHandler unable to remove file")
+				}
+			}
+		}
+	}
+	data, err := json.Marshal(out)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
 	}
 	w.WriteHeader(http.StatusOK)
+	w.Write(data)
 }
 
 // RegisterAgentHandler registers current agent with another one
@@ -369,10 +712,23 @@ func RegisterProtocolHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// RequestHandler initiate transfer work for given request
+// RequestHandler initiate transfer work for given request, its GET method
+// reports status of the agent requests, DELETE cancels and PUT changes
+// priority of the queued request
 func RequestHandler(w http.ResponseWriter, r *http.Request) {
 
-	if r.Method != "POST" {
+	switch r.Method {
+	case "POST":
+	case "GET":
+		RequestStatusHandler(w, r)
+		return
+	case "DELETE":
+		RequestCancelHandler(w, r)
+		return
+	case "PUT":
+		RequestPriorityHandler(w, r)
+		return
+	default:
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
@@ -395,16 +751,205 @@ func RequestHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// go through each request and queue items individually to run job over the given request
+	// validate all requests before any of them is stored or queued
+	var accepted []core.TransferRequest
 	for _, r := range *requests {
 
-		// let's create a job with the payload
-		work := core.Job{TransferRequest: r}
+		// request sent to destination agent can only be pulled by it
+		if r.Mode == "" {
+			r.Mode = core.PushMode
+			if r.DstAlias == _alias {
+				r.Mode = core.PullMode
+			}
+		}
+		if r.Mode != core.PushMode && r.Mode != core.PullMode {
+			log.WithFields(log.Fields{
+				"Request": r.String(),
+			}).Error("RequestHandler unknown transfer mode")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if r.Mode == core.PullMode {
+			if r.DstAlias != _alias && r.DstUrl != _myself {
+				log.WithFields(log.Fields{
+					"Request": r.String(),
+				}).Error("RequestHandler pull request of another destination")
+				http.Error(w, "pull request can only be accepted by its destination agent", http.StatusBadRequest)
+				return
+			}
+			if err := core.CheckPull(&r); err != nil {
+				log.WithFields(log.Fields{
+					"Request": r.String(),
+					"Error":   err,
+				}).Error("RequestHandler unable to accept pull request")
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		r.Id = 0   // id is always assigned by the agent
+		r.Pfn = "" // destination PFN is only assigned by repairs of the agent
+		accepted = append(accepted, r)
+	}
+
+	// store requests in agent DB to survive agent restarts, requests stored
+	// before a failure are cancelled since none of them is queued
+	for i := range accepted {
+		err = accepted[i].Persist(core.RequestQueued)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"Request": accepted[i].String(),
+				"Error":   err,
+			}).Error("RequestHandler unable to store request", err)
+			for j := 0; j < i; j++ {
+				accepted[j].SetStatus(core.RequestCancelled, err)
+			}
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// let's create a job with the payload of each request and push it onto the queue
+	for _, r := range accepted {
+		core.JobQueue <- core.Job{TransferRequest: r}
+	}
+
+	// send back accepted requests which carry their ids
+	data, err := json.Marshal(accepted)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"Error": err,
+		}).Error("RequestHandler unable to marshal accepted requests", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// RequestStatusHandler reports status of agent requests, a single request
+// can be selected by its id and requests can be filtered by status
+func RequestStatusHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var rid int64
+	if r.FormValue("id") != "" {
+		id, err := requestId(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rid = id
+	}
+	var status []string
+	if v := r.FormValue("status"); v != "" {
+		status = strings.Split(v, ",")
+	}
+	records, err := core.Requests(rid, status...)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"Id":     rid,
+			"Status": status,
+			"Error":  err,
+		}).Error("RequestStatusHandler unable to fetch requests", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	var data []byte
+	if rid != 0 {
+		if len(records) == 0 {
+			http.Error(w, fmt.Sprintf("Request %d not found", rid), http.StatusNotFound)
+			return
+		}
+		data, err = json.Marshal(records[0])
+	} else {
+		data, err = json.Marshal(records)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"Error": err,
+		}).Error("RequestStatusHandler unable to marshal requests", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// helper function to parse request id from HTTP request
+func requestId(r *http.Request) (int64, error) {
+	v := r.FormValue("id")
+	if v == "" {
+		return 0, fmt.Errorf("Request id is not provided")
+	}
+	rid, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid request id %s", v)
+	}
+	return rid, nil
+}
 
-		// Push the work onto the queue.
-		core.JobQueue <- work
+// helper function to write HTTP response for errors of request changes
+func requestError(w http.ResponseWriter, rid int64, err error) {
+	switch err {
+	case core.ErrNoRequest:
+		http.Error(w, fmt.Sprintf("Request %d not found", rid), http.StatusNotFound)
+	case core.ErrRequestState:
+		http.Error(w, fmt.Sprintf("Request %d: %v", rid, err), http.StatusConflict)
+	default:
+		log.WithFields(log.Fields{
+			"Id":    rid,
+			"Error": err,
+		}).Error("Unable to change request", err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// RequestCancelHandler cancels queued or held request with given id
+func RequestCancelHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "DELETE" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	rid, err := requestId(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = core.CancelRequest(rid)
+	if err != nil {
+		requestError(w, rid, err)
+		return
 	}
+	w.WriteHeader(http.StatusOK)
+}
 
+// RequestPriorityHandler changes priority of queued or held request with given id
+func RequestPriorityHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "PUT" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	rid, err := requestId(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	v := r.FormValue("priority")
+	priority, err := strconv.Atoi(v)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid priority %s", v), http.StatusBadRequest)
+		return
+	}
+	err = core.SetPriority(rid, priority)
+	if err != nil {
+		requestError(w, rid, err)
+		return
+	}
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -435,20 +980,38 @@ func UploadDataHandler(w http.ResponseWriter, r *http.Request) {
 
 	// parse header values and extract transfer record meta-data
 	srcBytes := r.Header.Get("Bytes")
-	srcHash := r.Header.Get("Hash")
+	hashType, srcSums, e := core.HeaderChecksums(r.Header)
+	if e != nil {
+		http.Error(w, e.Error(), http.StatusBadRequest)
+		return
+	}
 	dataset := r.Header.Get("Dataset")
 	block := r.Header.Get("Block")
 	srcAlias := r.Header.Get("Src")
 	dstAlias := r.Header.Get("Dst")
 	lfn := r.Header.Get("Lfn")
-	arr := strings.Split(lfn, "/")
-	fname := arr[len(arr)-1]
-	pfn := fmt.Sprintf("%s/%s", _backend, fname)
+	pfn, e := pfnName(lfn)
+	if e != nil {
+		log.WithFields(log.Fields{
+			"LFN":   lfn,
+			"Error": e,
+		}).Error("ERROR UploadDataHandler unable to map lfn")
+		http.Error(w, e.Error(), http.StatusInternalServerError)
+		return
+	}
+	if e := core.PreparePfn(pfn, hashType, srcSums); e != nil {
+		log.WithFields(log.Fields{
+			"PFN":   pfn,
+			"Error": e,
+		}).Error("ERROR UploadDataHandler unable to prepare", pfn, e)
+		http.Error(w, e.Error(), uploadErrorStatus(e))
+		return
+	}
 	time0 := time.Now().Unix()
 
-	// create a file which we'll write
-	file, e := os.Create(pfn)
-	defer file.Close()
+	// create a temporary file which we'll write and rename to pfn once data
+	// is verified
+	file, e := core.TempFile(pfn)
 	if e != nil {
 		log.WithFields(log.Fields{
 			"PFN":   pfn,
@@ -457,8 +1020,13 @@ func UploadDataHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, e.Error(), http.StatusInternalServerError)
 		return
 	}
-	// create a hasher to calculate data hash
-	hasher := adler32.New()
+	// create hashers to calculate data checksums
+	hasher, e := utils.NewChecksumWriter(core.ChecksumTypes(hashType, srcSums)...)
+	if e != nil {
+		core.DiscardFile(file)
+		http.Error(w, e.Error(), http.StatusBadRequest)
+		return
+	}
 
 	// loop over parts of HTTP request, pass it through TeeReader to destination file and collect bytes
 	var totBytes int64
@@ -467,14 +1035,16 @@ func UploadDataHandler(w http.ResponseWriter, r *http.Request) {
 		if e == io.EOF {
 			break
 		}
-		if p.FileName() == "" {
-			continue
-		}
 		if e != nil {
 			log.WithFields(log.Fields{
 				"Error": e,
 			}).Error("UploadDataHandler unable to read chunk from the stream", e)
-			break
+			core.DiscardFile(file)
+			http.Error(w, e.Error(), http.StatusBadRequest)
+			return
+		}
+		if p.FileName() == "" {
+			continue
 		}
 		// here is pipe: mr->p->hasher->file
 		reader := io.TeeReader(p, hasher)
@@ -495,17 +1065,27 @@ func UploadDataHandler(w http.ResponseWriter, r *http.Request) {
 			"Total Bytes":  totBytes,
 			"Error":        e,
 		}).Error("UploadDataHandler bytes mismatch", srcBytes, totBytes, e)
+		core.DiscardFile(file)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	hash := hex.EncodeToString(hasher.Sum(nil))
-	if srcHash != hash {
+	sums := hasher.Sums()
+	if e := core.VerifyChecksums(srcSums, sums); e != nil {
 		log.WithFields(log.Fields{
-			"Source Hash": srcHash,
-			"Hash":        hash,
-			"Error":       e,
-		}).Error("UploadDataHandler hash mismatch", srcHash, hash, e)
+			"Source Checksums": utils.FormatChecksums(srcSums),
+			"Checksums":        utils.FormatChecksums(sums),
+			"Error":            e,
+		}).Error("UploadDataHandler hash mismatch", e)
+		core.DiscardFile(file)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if e := core.CommitFile(file, pfn); e != nil {
+		log.WithFields(log.Fields{
+			"PFN":   pfn,
+			"Error": e,
+		}).Error("UploadDataHandler unable to commit", pfn, e)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -515,11 +1095,12 @@ func UploadDataHandler(w http.ResponseWriter, r *http.Request) {
 	// data is transferred, then it will update the TFC
 	log.WithFields(log.Fields{
 		"Source Alias": srcAlias,
-		"Fname":        fname,
+		"LFN":          lfn,
 		"Dest Alias":   dstAlias,
 		"PFN":          pfn,
 	}).Println("UploadDataHandler wrote")
-	entry := core.CatalogEntry{Lfn: lfn, Pfn: pfn, Dataset: dataset, Block: block, Bytes: totBytes, Hash: hash, TransferTime: (time.Now().Unix() - time0), Timestamp: time.Now().Unix()}
+	entry := core.CatalogEntry{Lfn: lfn, Pfn: pfn, Dataset: dataset, Block: block, Bytes: totBytes, HashType: hashType, TransferTime: (time.Now().Unix() - time0), Timestamp: time.Now().Unix()}
+	entry.SetChecksums(sums)
 	data, e := json.Marshal(entry)
 	if e != nil {
 		log.WithFields(log.Fields{
@@ -533,6 +1114,442 @@ func UploadDataHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(data)
 }
 
+// DownloadHandler serves content of a file registered in agent TFC, it is
+// used by destination agents in pull mode. The file meta-data are sent in
+// response headers and Range requests are supported.
+func DownloadHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	lfn := r.FormValue("lfn")
+	if lfn == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	records := core.TFC.Records(core.TransferRequest{File: lfn})
+	if len(records) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	rec := records[0]
+	file, err := os.Open(rec.Pfn)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"Record": rec.String(),
+			"Error":  err,
+		}).Error("DownloadHandler unable to open file")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Lfn", rec.Lfn)
+	w.Header().Set("Dataset", rec.Dataset)
+	w.Header().Set("Block", rec.Block)
+	w.Header().Set("Bytes", fmt.Sprintf("%d", rec.Bytes))
+	w.Header().Set("Hash", rec.Hash)
+	w.Header().Set("Hash-Type", rec.HashAlgorithm())
+	w.Header().Set("Checksums", utils.FormatChecksums(rec.AllChecksums()))
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), file)
+}
+
+// helper function to construct pfn of uploaded file from its lfn by using
+// mapping rules of agent TFC
+func pfnName(lfn string) (string, error) {
+	return core.BackendPfn(core.TFC.Rules, "http", lfn, _backend)
+}
+
+// helper function to return HTTP status code of failed upload
+func uploadErrorStatus(err error) int {
+	if err == core.ErrPfnConflict {
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// helper function to write data from given reader into pfn, data is written
+// into temporary file which is renamed to pfn once its size and checksums
+// match source ones. It returns number of written bytes and data checksums
+// for given algorithms.
+func writeData(pfn string, r io.Reader, srcBytes string, srcSums map[string]string, algs ...string) (int64, map[string]string, error) {
+	hasher, err := utils.NewChecksumWriter(algs...)
+	if err != nil {
+		return 0, nil, err
+	}
+	file, err := core.TempFile(pfn)
+	if err != nil {
+		return 0, nil, err
+	}
+	// here is pipe: r->hasher->file
+	b, err := io.Copy(file, io.TeeReader(r, hasher))
+	if err == nil && srcBytes != fmt.Sprintf("%d", b) {
+		err = fmt.Errorf("bytes mismatch, source %s, received %d", srcBytes, b)
+	}
+	sums := hasher.Sums()
+	if err == nil {
+		err = core.VerifyChecksums(srcSums, sums)
+	}
+	if err != nil {
+		core.DiscardFile(file)
+		return b, nil, err
+	}
+	return b, sums, core.CommitFile(file, pfn)
+}
+
+// BulkUploadHandler uploads multiple files within single HTTP request and
+// sends back transfer results for every file. Every part of multipart stream
+// carries meta-data of its file in part headers.
+func BulkUploadHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	defer r.Body.Close()
+
+	mr, e := r.MultipartReader()
+	if e != nil {
+		log.WithFields(log.Fields{
+			"Error": e,
+		}).Error("BulkUploadHandler unable to establish MultipartReader", e)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	srcAlias := r.Header.Get("Src")
+	dstAlias := r.Header.Get("Dst")
+
+	var results []core.TransferResult
+	for {
+		p, e := mr.NextPart()
+		if e == io.EOF {
+			break
+		}
+		if e != nil {
+			log.WithFields(log.Fields{
+				"Error": e,
+			}).Error("BulkUploadHandler unable to read part from the stream", e)
+			break
+		}
+		if p.FileName() == "" {
+			continue
+		}
+		time0 := time.Now().Unix()
+		lfn := p.Header.Get("Lfn")
+		res := core.TransferResult{Lfn: lfn}
+		pfn, e := pfnName(lfn)
+		var hashType string
+		var srcSums map[string]string
+		if e == nil {
+			hashType, srcSums, e = core.HeaderChecksums(p.Header)
+		}
+		var totBytes int64
+		var sums map[string]string
+		if e == nil {
+			e = core.PreparePfn(pfn, hashType, srcSums)
+		}
+		if e == nil {
+			totBytes, sums, e = writeData(pfn, p, p.Header.Get("Bytes"), srcSums, core.ChecksumTypes(hashType, srcSums)...)
+		}
+		if e != nil {
+			res.Error = e.Error()
+		} else {
+			res.Entry = core.CatalogEntry{Lfn: lfn, Pfn: pfn, Dataset: p.Header.Get("Dataset"), Block: p.Header.Get("Block"), Bytes: totBytes, HashType: hashType, TransferTime: (time.Now().Unix() - time0), Timestamp: time.Now().Unix()}
+			res.Entry.SetChecksums(sums)
+		}
+		if res.Error != "" {
+			log.WithFields(log.Fields{
+				"Source Alias": srcAlias,
+				"LFN":          lfn,
+				"PFN":          pfn,
+				"Error":        res.Error,
+			}).Error("BulkUploadHandler unable to upload")
+		}
+		results = append(results, res)
+	}
+	log.WithFields(log.Fields{
+		"Source Alias": srcAlias,
+		"Dest Alias":   dstAlias,
+		"Files":        len(results),
+	}).Println("BulkUploadHandler wrote")
+
+	// send back transfer results, the other end should register successfully
+	// transferred files in our TFC
+	data, e := json.Marshal(results)
+	if e != nil {
+		log.WithFields(log.Fields{
+			"Error": e,
+		}).Error("BulkUploadHandler unable to marshal transfer results", e)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// chunks mutex guards look-up of stored chunks and completion of chunked uploads
+var _chunksMutex sync.Mutex
+
+// lfns of chunked uploads which are being completed
+var _completing = make(map[string]bool)
+
+// helper function to write upload state to HTTP response
+func writeUploadState(w http.ResponseWriter, status int, state core.UploadState) {
+	data, err := json.Marshal(state)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"State": state.String(),
+			"Error": err,
+		}).Error("ChunkUploadHandler unable to marshal upload state", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+// helper function to get stored chunks of given upload, chunks are discarded
+// if their temporary file is gone, e.g. it was cleaned up on agent start
+func uploadChunks(lfn, fileHash, tmp string) ([]core.ChunkInfo, error) {
+	chunks, err := core.StoredChunks(lfn, fileHash)
+	if err != nil || len(chunks) == 0 {
+		return chunks, err
+	}
+	if _, err := os.Stat(tmp); os.IsNotExist(err) {
+		log.WithFields(log.Fields{
+			"LFN":  lfn,
+			"File": tmp,
+		}).Warn("Discard chunks without temporary file")
+		return nil, core.DeleteChunks(lfn)
+	}
+	return chunks, nil
+}
+
+// ChunkUploadHandler uploads files in chunks. Its GET method reports upload
+// state of a file, i.e. stored chunks and offset to resume upload from, while
+// POST method stores a chunk at given offset. Chunks may arrive in any order
+// and concurrently, they are written into temporary file which is renamed to
+// its pfn once all chunks are received and the file checksum is verified.
+func ChunkUploadHandler(w http.ResponseWriter, r *http.Request) {
+
+	if !(r.Method == "POST" || r.Method == "GET") {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	defer r.Body.Close()
+
+	if r.Method == "GET" {
+		lfn := r.FormValue("lfn")
+		pfn, err := pfnName(lfn)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		_chunksMutex.Lock()
+		chunks, err := uploadChunks(lfn, r.FormValue("hash"), core.ChunkFile(pfn))
+		_chunksMutex.Unlock()
+		if err != nil {
+			log.WithFields(log.Fields{
+				"LFN":   lfn,
+				"Error": err,
+			}).Error("ChunkUploadHandler unable to get stored chunks", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		state := core.UploadState{Lfn: lfn, Offset: core.ResumeOffset(chunks), Chunks: chunks}
+		writeUploadState(w, http.StatusOK, state)
+		return
+	}
+
+	// parse header values and extract chunk meta-data
+	lfn := r.Header.Get("Lfn")
+	srcHash := r.Header.Get("Hash")
+	chunkHash := r.Header.Get("Chunk-Hash")
+	srcBytes, e1 := strconv.ParseInt(r.Header.Get("Bytes"), 10, 64)
+	offset, e2 := strconv.ParseInt(r.Header.Get("Offset"), 10, 64)
+	if lfn == "" || e1 != nil || e2 != nil {
+		http.Error(w, "Lfn, Bytes and Offset headers are required", http.StatusBadRequest)
+		return
+	}
+	hashType, srcSums, err := core.HeaderChecksums(r.Header)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	pfn, err := pfnName(lfn)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tmp := core.ChunkFile(pfn)
+	time0 := time.Now().Unix()
+
+	if offset < 0 || (offset >= srcBytes && srcBytes > 0) {
+		http.Error(w, fmt.Sprintf("Offset %d is out of file range", offset), http.StatusBadRequest)
+		return
+	}
+
+	_chunksMutex.Lock()
+	chunks, err := uploadChunks(lfn, srcHash, tmp)
+	_chunksMutex.Unlock()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"LFN":   lfn,
+			"Error": err,
+		}).Error("ChunkUploadHandler unable to get stored chunks", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if len(chunks) == 0 {
+		// first chunk of the upload, make sure we can put the file in place
+		if err := core.PreparePfn(pfn, hashType, srcSums); err != nil {
+			http.Error(w, err.Error(), uploadErrorStatus(err))
+			return
+		}
+	}
+	stored := false
+	for _, c := range chunks {
+		if c.Offset == offset {
+			stored = true // chunk is re-sent, we already have it
+			break
+		}
+	}
+
+	if !stored {
+		// write chunk at its offset, here is pipe: r.Body->hasher->file
+		// chunks of the file may arrive concurrently via multiple streams
+		file, err := core.OpenChunkFile(pfn)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"PFN":   tmp,
+				"Error": err,
+			}).Error("ChunkUploadHandler unable to open", tmp, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		hasher := adler32.New()
+		_, err = file.Seek(offset, io.SeekStart)
+		var b int64
+		if err == nil {
+			b, err = io.Copy(file, io.TeeReader(io.LimitReader(r.Body, srcBytes-offset), hasher))
+		}
+		if err == nil {
+			err = file.Sync()
+		}
+		hash := hex.EncodeToString(hasher.Sum(nil))
+		if err == nil && hash != chunkHash {
+			err = fmt.Errorf("chunk hash mismatch, source %s, received %s", chunkHash, hash)
+		}
+		file.Close()
+		if err != nil {
+			log.WithFields(log.Fields{
+				"LFN":    lfn,
+				"Offset": offset,
+				"Error":  err,
+			}).Error("ChunkUploadHandler unable to store chunk", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		err = core.AddChunk(lfn, srcHash, core.ChunkInfo{Offset: offset, Bytes: b, Hash: hash})
+		if err != nil {
+			log.WithFields(log.Fields{
+				"LFN":   lfn,
+				"Error": err,
+			}).Error("ChunkUploadHandler unable to record chunk", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// check if all chunks are received, only one request completes the upload
+	_chunksMutex.Lock()
+	chunks, err = core.StoredChunks(lfn, srcHash)
+	complete := err == nil && len(core.MissingChunks(chunks, srcBytes, srcBytes)) == 0 && !_completing[lfn]
+	if complete {
+		_completing[lfn] = true
+	}
+	_chunksMutex.Unlock()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"LFN":   lfn,
+			"Error": err,
+		}).Error("ChunkUploadHandler unable to get stored chunks", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	state := core.UploadState{Lfn: lfn, Offset: core.ResumeOffset(chunks), Chunks: chunks}
+	if !complete {
+		writeUploadState(w, http.StatusOK, state)
+		return
+	}
+	defer func() {
+		_chunksMutex.Lock()
+		delete(_completing, lfn)
+		_chunksMutex.Unlock()
+	}()
+
+	// all chunks are received, verify the file and put it in place
+	// file may have a tail from upload of another version, drop it first
+	err = os.Truncate(tmp, srcBytes)
+	var file *os.File
+	if err == nil {
+		file, err = os.Open(tmp)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sums, totBytes, err := utils.Checksums(file, core.ChecksumTypes(hashType, srcSums)...)
+	file.Close()
+	if err == nil && totBytes != srcBytes {
+		err = fmt.Errorf("file mismatch, source bytes=%d, received bytes=%d", srcBytes, totBytes)
+	}
+	if err == nil {
+		err = core.VerifyChecksums(srcSums, sums)
+	}
+	if err == nil {
+		err = core.PreparePfn(pfn, hashType, srcSums)
+	}
+	if err == nil {
+		err = os.Rename(tmp, pfn)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"LFN":   lfn,
+			"PFN":   pfn,
+			"Error": err,
+		}).Error("ChunkUploadHandler unable to complete upload", err)
+		// start over with the next upload attempt
+		os.Remove(tmp)
+		core.DeleteChunks(lfn)
+		http.Error(w, err.Error(), uploadErrorStatus(err))
+		return
+	}
+	err = core.DeleteChunks(lfn)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"LFN":   lfn,
+			"Error": err,
+		}).Error("ChunkUploadHandler unable to delete chunk records", err)
+	}
+	log.WithFields(log.Fields{
+		"Source Alias": r.Header.Get("Src"),
+		"LFN":          lfn,
+		"Dest Alias":   r.Header.Get("Dst"),
+		"PFN":          pfn,
+		"Chunks":       len(state.Chunks),
+	}).Println("ChunkUploadHandler wrote")
+	state.Entry = &core.CatalogEntry{Lfn: lfn, Pfn: pfn, Dataset: r.Header.Get("Dataset"), Block: r.Header.Get("Block"), Bytes: totBytes, HashType: hashType, TransferTime: (time.Now().Unix() - time0), Timestamp: time.Now().Unix()}
+	state.Entry.SetChecksums(sums)
+	writeUploadState(w, http.StatusOK, state)
+}
+
 // helper data structure to change verbosity level of the running server
 type level struct {
 	Level int `json:"level"`
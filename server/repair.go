@@ -0,0 +1,143 @@
+package server
+
+// transfer2go repair of missing and corrupt files from replicas of other agents
+// Copyright (c) 2017 - Valentin Kuznetsov <vkuznet@gmail.com>
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vkuznet/transfer2go/core"
+	"github.com/vkuznet/transfer2go/utils"
+)
+
+// helper function to check whether remote agent holds a good replica of given
+// catalog entry, i.e. its /files API knows the LFN and its TFC entry has the
+// same size and checksums
+func hasReplica(aurl string, rec core.CatalogEntry) (bool, error) {
+	rurl := fmt.Sprintf("%s/files?lfn=%s", aurl, url.QueryEscape(rec.Lfn))
+	resp := utils.FetchResponse(rurl, []byte{})
+	if resp.Error != nil {
+		return false, resp.Error
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("unable to get files from %s, status %s", aurl, resp.Status)
+	}
+	var files []string
+	if err := json.Unmarshal(resp.Data, &files); err != nil {
+		return false, err
+	}
+	if !utils.InList(rec.Lfn, files) {
+		return false, nil
+	}
+	rurl = fmt.Sprintf("%s/tfc?lfn=%s", aurl, url.QueryEscape(rec.Lfn))
+	resp = utils.FetchResponse(rurl, []byte{})
+	if resp.Error != nil {
+		return false, resp.Error
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("unable to get records from %s, status %s", aurl, resp.Status)
+	}
+	var records []core.CatalogEntry
+	if err := json.Unmarshal(resp.Data, &records); err != nil {
+		return false, err
+	}
+	for _, r := range records {
+		if r.Lfn == rec.Lfn && sameFile(r, rec) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// helper function to check that catalog entries describe the same file, i.e.
+// they have the same size, share at least one checksum algorithm and their
+// checksums of common algorithms match
+func sameFile(a, b core.CatalogEntry) bool {
+	if a.Bytes != b.Bytes {
+		return false
+	}
+	sums := b.AllChecksums()
+	common := 0
+	for alg, sum := range a.AllChecksums() {
+		if s, ok := sums[alg]; ok {
+			if s != sum {
+				return false
+			}
+			common++
+		}
+	}
+	return common > 0
+}
+
+// helper function to store transfer request in agent DB and put it on a queue
+func queueRequest(t *core.TransferRequest) error {
+	t.Id = 0 // id is always assigned by the agent
+	if err := t.Persist(core.RequestQueued); err != nil {
+		return err
+	}
+	core.JobQueue <- core.Job{TransferRequest: *t}
+	return nil
+}
+
+// repairFile implements core.RepairFunc, it looks up agent which holds good
+// replica of missing or corrupt file and queues pull of the file from that
+// agent into PFN of its catalog entry. Corrupt file is kept until the replica
+// is verified and replaced by it, the catalog entry is updated once transfer
+// succeeds.
+func repairFile(rec core.CatalogEntry, p core.FileProblem) (int64, string, error) {
+	var aliases []string
+	for alias := range _agents {
+		if alias != _alias {
+			aliases = append(aliases, alias)
+		}
+	}
+	sort.Strings(aliases)
+	for _, alias := range aliases {
+		aurl := _agents[alias]
+		ok, err := hasReplica(aurl, rec)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"Agent": alias,
+				"Lfn":   rec.Lfn,
+				"Error": err,
+			}).Warn("Unable to look up replica")
+			continue
+		}
+		if !ok {
+			continue
+		}
+		t := core.TransferRequest{TimeStamp: time.Now().Unix(), File: rec.Lfn, SrcUrl: aurl, SrcAlias: alias, DstUrl: _myself, DstAlias: _alias, Mode: core.PullMode, Repair: p.Status == core.FileCorrupt, Pfn: rec.Pfn}
+		if err := core.CheckPull(&t); err != nil {
+			log.WithFields(log.Fields{
+				"Agent": alias,
+				"Lfn":   rec.Lfn,
+				"Error": err,
+			}).Warn("Unable to pull replica")
+			continue
+		}
+		if err := queueRequest(&t); err != nil {
+			return 0, "", err
+		}
+		log.WithFields(log.Fields{
+			"Lfn":     rec.Lfn,
+			"Agent":   alias,
+			"Request": t.Id,
+		}).Info("Queued repair transfer")
+		return t.Id, fmt.Sprintf("queued transfer of replica from %s", alias), nil
+	}
+	return 0, "", fmt.Errorf("no agent holds good replica of the file")
+}
+
+// helper function to return repair function of consistency checks
+func repairer(repair bool) core.RepairFunc {
+	if !repair {
+		return nil
+	}
+	return repairFile
+}
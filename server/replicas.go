@@ -0,0 +1,145 @@
+package server
+
+// transfer2go gossip of replica index between agents
+// Copyright (c) 2017 - Valentin Kuznetsov <vkuznet@gmail.com>
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vkuznet/transfer2go/core"
+	"github.com/vkuznet/transfer2go/utils"
+)
+
+// GossipFanout defines number of randomly chosen agents which receive blocks
+// of the agent in every gossip round
+var GossipFanout = 3
+
+// helper function to construct gossip of this agent, i.e. its blocks
+func replicaGossip() (core.ReplicaGossip, error) {
+	g := core.ReplicaGossip{Agent: _alias}
+	blocks, err := core.TFC.Blocks(_alias, _myself, "", "")
+	if err != nil {
+		return g, err
+	}
+	g.Timestamp = time.Now().Unix()
+	g.Blocks = blocks
+	return g, nil
+}
+
+// helper function to send replica index of this agent to randomly chosen
+// agents
+func gossip(rnd *rand.Rand) error {
+	g, err := replicaGossip()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(g)
+	if err != nil {
+		return err
+	}
+	var peers []string
+	for alias, aurl := range _agents {
+		if alias != _alias {
+			peers = append(peers, aurl)
+		}
+	}
+	for i, j := range rnd.Perm(len(peers)) {
+		if i == GossipFanout {
+			break
+		}
+		rurl := fmt.Sprintf("%s/replicas", peers[j])
+		resp := utils.FetchResponse(rurl, data) // POST request
+		if resp.Error == nil && resp.StatusCode != http.StatusOK {
+			resp.Error = fmt.Errorf("%s %s", resp.Status, string(resp.Data))
+		}
+		if resp.Error != nil {
+			log.WithFields(log.Fields{
+				"Agent": peers[j],
+				"Error": resp.Error,
+			}).Warn("Unable to send replica gossip")
+		}
+	}
+	return nil
+}
+
+// helper function to gossip replica index with given interval
+func gossipReplicas(interval time.Duration) {
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for {
+		time.Sleep(interval)
+		if err := gossip(rnd); err != nil {
+			log.WithFields(log.Fields{
+				"Error": err,
+			}).Error("Unable to gossip replica index")
+		}
+	}
+}
+
+// ReplicasHandler returns replicas of blocks matching dataset and block
+// parameters, which may contain * wildcard, on GET request. Replicas can be
+// restricted to given agent, blocks of this agent are included as confirmed
+// at the time of the request. POST request applies replica gossip of another
+// agent.
+func ReplicasHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if r.Method == "POST" {
+		var g core.ReplicaGossip
+		if err := json.NewDecoder(r.Body).Decode(&g); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if g.Agent == "" || g.Agent == _alias {
+			http.Error(w, fmt.Sprintf("invalid gossip agent %s", g.Agent), http.StatusBadRequest)
+			return
+		}
+		if err := g.Apply(_alias); err != nil {
+			log.WithFields(log.Fields{
+				"Agent": g.Agent,
+				"Error": err,
+			}).Error("ReplicasHandler unable to apply gossip")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	agent := r.FormValue("agent")
+	dataset := r.FormValue("dataset")
+	block := r.FormValue("block")
+	var replicas []core.Replica
+	var err error
+	if agent == "" || agent == _alias {
+		replicas, err = core.TFC.Blocks(_alias, _myself, dataset, block)
+	}
+	if err == nil && agent != _alias {
+		var others []core.Replica
+		others, err = core.Replicas(agent, dataset, block)
+		replicas = append(replicas, others...)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"Error": err,
+		}).Error("ReplicasHandler unable to get replicas")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if replicas == nil {
+		replicas = []core.Replica{}
+	}
+	data, err := json.Marshal(replicas)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
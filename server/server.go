@@ -10,7 +10,9 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"os"
 	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/vkuznet/transfer2go/core"
@@ -22,28 +24,37 @@ import (
 
 // Config type holds server configuration
 type Config struct {
-	Name      string `json:"name"`      // agent name, aka site name
-	Url       string `json:"url"`       // agent url
-	Catalog   string `json:"catalog"`   // catalog file name, e.g. catalog.db
-	Protocol  string `json:"protocol"`  // backend protocol, e.g. srmv2
-	Backend   string `json:"backend"`   // backend, e.g. srm
-	Tool      string `json:"tool"`      // backend tool, e.g. srmcp
-	ToolOpts  string `json:"toolopts"`  // options for backend tool
-	Mfile     string `json:"mfile"`     // metrics file name
-	Minterval int64  `json:"minterval"` // metrics interval
-	Staticdir string `json:"staticdir"` // static dir defines location of static files, e.g. sql,js templates
-	Workers   int    `json:"workers"`   // number of workers
-	QueueSize int    `json:"queuesize"` // total size of the queue
-	Port      int    `json:"port"`      // port number given server runs on, default 8989
-	Base      string `json:"base"`      // URL base path for agent server, it will be extracted from Url
-	Register  string `json:"register"`  // remote agent URL to register
-	ServerKey string `json:"serverkey"` // server key file
-	ServerCrt string `json:"servercrt"` // server crt file
+	Name      string   `json:"name"`      // agent name, aka site name
+	Url       string   `json:"url"`       // agent url
+	Catalog   string   `json:"catalog"`   // catalog file name, e.g. catalog.db
+	Protocol  string   `json:"protocol"`  // backend protocol, e.g. srmv2
+	Backend   string   `json:"backend"`   // backend, e.g. srm
+	Tool      string   `json:"tool"`      // backend tool, e.g. srmcp
+	ToolOpts  string   `json:"toolopts"`  // options for backend tool
+	Mfile     string   `json:"mfile"`     // metrics file name
+	Minterval int64    `json:"minterval"` // metrics interval
+	Staticdir string   `json:"staticdir"` // static dir defines location of static files, e.g. sql,js templates
+	Workers   int      `json:"workers"`   // number of workers
+	QueueSize int      `json:"queuesize"` // total size of the queue
+	BulkSize  int      `json:"bulksize"`  // max number of files shipped in a single bulk transfer
+	ChunkSize int64    `json:"chunksize"` // size of chunks in bytes used to upload large files
+	Streams   int      `json:"streams"`   // number of concurrent streams used to upload chunks of a file
+	Mode      string   `json:"mode"`      // transfer mode used to deliver files to this agent, push or pull
+	Checksums []string `json:"checksums"` // checksum algorithms computed for received files, e.g. adler32, sha256
+	Port      int      `json:"port"`      // port number given server runs on, default 8989
+	Base      string   `json:"base"`      // URL base path for agent server, it will be extracted from Url
+	Register  string   `json:"register"`  // remote agent URL to register
+	ServerKey string   `json:"serverkey"` // server key file
+	ServerCrt string   `json:"servercrt"` // server crt file
+	Cinterval int64    `json:"cinterval"` // interval in seconds of background consistency checks of catalog against backend, zero disables them
+	Cquick    bool     `json:"cquick"`    // background consistency checks compare file sizes only
+	Crepair   bool     `json:"crepair"`   // repair missing and corrupt files found by consistency checks from replicas of other agents
+	Ginterval int64    `json:"ginterval"` // interval in seconds of replica index gossip with other agents, negative value disables it
 }
 
 // String returns string representation of Config data type
 func (c *Config) String() string {
-	return fmt.Sprintf("<Config: name=%s url=%s port=%d base=%s catalog=%s protocol=%s backend=%s tool=%s opts=%s mfile=%s minterval=%d staticdir=%s workders=%d queuesize=%d register=%s>", c.Name, c.Url, c.Port, c.Base, c.Catalog, c.Protocol, c.Backend, c.Tool, c.ToolOpts, c.Mfile, c.Minterval, c.Staticdir, c.Workers, c.QueueSize, c.Register)
+	return fmt.Sprintf("<Config: name=%s url=%s port=%d base=%s catalog=%s protocol=%s backend=%s tool=%s opts=%s mfile=%s minterval=%d staticdir=%s workders=%d queuesize=%d bulksize=%d chunksize=%d streams=%d mode=%s checksums=%v register=%s cinterval=%d cquick=%v crepair=%v ginterval=%d>", c.Name, c.Url, c.Port, c.Base, c.Catalog, c.Protocol, c.Backend, c.Tool, c.ToolOpts, c.Mfile, c.Minterval, c.Staticdir, c.Workers, c.QueueSize, c.BulkSize, c.ChunkSize, c.Streams, c.Mode, c.Checksums, c.Register, c.Cinterval, c.Cquick, c.Crepair, c.Ginterval)
 }
 
 // AgentInfo data type
@@ -61,7 +72,7 @@ type AgentProtocol struct {
 }
 
 // globals used in server/handlers
-var _myself, _alias, _protocol, _backend, _tool, _toolOpts string
+var _myself, _alias, _protocol, _backend, _tool, _toolOpts, _mode string
 var _agents map[string]string
 var _config Config
 
@@ -70,6 +81,18 @@ func init() {
 	_agents = make(map[string]string)
 }
 
+// helper function to return agent backend if it is a local directory, i.e.
+// files of the backend can be listed to find orphans
+func storageDir() string {
+	if _backend == "" {
+		return ""
+	}
+	if fi, err := os.Stat(_backend); err != nil || !fi.IsDir() {
+		return ""
+	}
+	return _backend
+}
+
 // register a new (alias, agent) pair in agent (register)
 func register(register, alias, agent string) error {
 	log.WithFields(log.Fields{
@@ -148,7 +171,20 @@ func Server(config Config) {
 	_backend = config.Backend
 	_tool = config.Tool
 	_toolOpts = config.ToolOpts
+	_mode = config.Mode
 	utils.STATICDIR = config.Staticdir
+	core.BulkSize = config.BulkSize
+	core.ChunkSize = config.ChunkSize
+	core.Streams = config.Streams
+	core.Checksums = config.Checksums
+	for _, alg := range config.Checksums {
+		if _, err := utils.NewHasher(alg); err != nil {
+			log.WithFields(log.Fields{
+				"Checksums": config.Checksums,
+				"Supported": utils.ChecksumAlgorithms(),
+			}).Fatal("Unable to use checksum algorithm", err)
+		}
+	}
 	arr := strings.Split(_myself, "/")
 	base := ""
 	if len(arr) > 3 {
@@ -179,9 +215,19 @@ func Server(config Config) {
 			"Error": err,
 		}).Fatal("Unable to parse catalog JSON file")
 	}
+	if err := core.TFC.Rules.Validate(); err != nil {
+		log.WithFields(log.Fields{
+			"Error": err,
+		}).Fatal("Invalid LFN to PFN mapping rules")
+	}
 	// open up Catalog DB
 	dbtype := core.TFC.Type
-	dburi := core.TFC.Uri // TODO: may be I need to change this based on DB Login/Password, check MySQL
+	dburi, err := core.TFC.DSN()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"Error": err,
+		}).Fatal("Unable to construct catalog DB connection string")
+	}
 	dbowner := core.TFC.Owner
 	db, dberr := sql.Open(dbtype, dburi)
 	defer db.Close()
@@ -200,10 +246,29 @@ func Server(config Config) {
 	core.DB = db
 	core.DBTYPE = dbtype
 	core.DBSQL = core.LoadSQL(dbtype, dbowner)
+	err = core.InitSchema()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"DB Error": err,
+		}).Fatal("Unable to initialize DB schema")
+	}
 	log.WithFields(log.Fields{
 		"Catalog": core.TFC,
 	}).Println("")
 
+	// remove temporary files of transfers interrupted by agent shutdown
+	count, failed, err := core.CleanTempFiles()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"Error": err,
+		}).Error("Unable to clean temporary files")
+	} else if count > 0 || failed > 0 {
+		log.WithFields(log.Fields{
+			"Files":   count,
+			"Skipped": failed,
+		}).Info("Removed temporary files")
+	}
+
 	// define handlers
 	http.HandleFunc(fmt.Sprintf("%s/", base), AuthHandler)
 
@@ -215,6 +280,25 @@ func Server(config Config) {
 		"QueueSize": config.QueueSize,
 	}).Println("Start dispatcher with workers of queue size")
 
+	// put back on a queue all requests which were not completed by previous agent run
+	go core.ReplayRequests()
+
+	// periodically verify that catalog entries match files in agent backend
+	if config.Cinterval > 0 {
+		check := core.ConsistencyCheck{Protocol: _protocol, Dir: storageDir(), Quick: config.Cquick, Repair: repairer(config.Crepair)}
+		go core.ConsistencyChecks(check, time.Duration(config.Cinterval)*time.Second)
+		log.WithFields(log.Fields{
+			"Interval": config.Cinterval,
+			"Quick":    config.Cquick,
+			"Repair":   config.Crepair,
+		}).Println("Schedule consistency checks")
+	}
+
+	// exchange replica index with other agents
+	if config.Ginterval > 0 {
+		go gossipReplicas(time.Duration(config.Ginterval) * time.Second)
+	}
+
 	if authVar {
 		//start HTTPS server which require user certificates
 		server := &http.Server{
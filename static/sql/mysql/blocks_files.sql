@@ -0,0 +1,2 @@
+SELECT D.dataset, B.block, COUNT(F.id), SUM(F.bytes)
+FROM FILES AS F JOIN BLOCKS AS B ON F.BLOCKID=B.ID JOIN DATASETS AS D ON F.DATASETID = D.ID
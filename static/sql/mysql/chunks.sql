@@ -0,0 +1 @@
+SELECT filehash, pos, bytes, hash FROM CHUNKS WHERE lfn=? ORDER BY pos
@@ -0,0 +1 @@
+DELETE FROM DATASETS WHERE id NOT IN (SELECT datasetid FROM FILES)
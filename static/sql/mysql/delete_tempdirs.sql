@@ -0,0 +1 @@
+DELETE FROM TEMPDIRS WHERE dir=?
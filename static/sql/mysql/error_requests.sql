@@ -0,0 +1 @@
+UPDATE REQUESTS SET status=?, error=?, timestamp=? WHERE id=?
@@ -0,0 +1 @@
+DELETE FROM REPLICAS WHERE agent=? AND timestamp<?
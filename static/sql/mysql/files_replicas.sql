@@ -0,0 +1 @@
+SELECT files, bytes FROM REPLICAS WHERE agent=? AND block=?
@@ -0,0 +1 @@
+INSERT IGNORE INTO BLOCKS(block) VALUES(?)
@@ -0,0 +1 @@
+INSERT INTO CHECKSUMS(fileid, type, hash) VALUES(?,?,?) ON DUPLICATE KEY UPDATE hash=VALUES(hash)
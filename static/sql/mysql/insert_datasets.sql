@@ -0,0 +1 @@
+INSERT IGNORE INTO DATASETS(dataset) VALUES(?)
@@ -0,0 +1 @@
+INSERT INTO FILES(lfn, pfn, blockid, datasetid, bytes, hash, hashtype, transfertime, timestamp) VALUES(?,?,?,?,?,?,?,?,?)
@@ -0,0 +1,2 @@
+INSERT INTO REPLICAS(agent, url, dataset, block, files, bytes, timestamp) VALUES(?,?,?,?,?,?,?)
+ON DUPLICATE KEY UPDATE url=IF(VALUES(timestamp)>=timestamp, VALUES(url), url), dataset=IF(VALUES(timestamp)>=timestamp, VALUES(dataset), dataset), files=IF(VALUES(timestamp)>=timestamp, VALUES(files), files), bytes=IF(VALUES(timestamp)>=timestamp, VALUES(bytes), bytes), timestamp=GREATEST(VALUES(timestamp), timestamp)
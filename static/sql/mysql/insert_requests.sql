@@ -0,0 +1 @@
+INSERT INTO REQUESTS(request, status, attempts, error, bytes, timestamp) VALUES(?,?,0,'',0,?)
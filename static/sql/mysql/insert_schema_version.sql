@@ -0,0 +1 @@
+INSERT INTO SCHEMA_VERSION(version, timestamp) VALUES(?,?)
@@ -0,0 +1 @@
+INSERT IGNORE INTO TEMPDIRS(dir, timestamp) VALUES(?,?)
@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS FILES(id BIGINT AUTO_INCREMENT PRIMARY KEY, lfn VARCHAR(700) UNIQUE, pfn TEXT, blockid BIGINT, datasetid BIGINT, bytes BIGINT, hash VARCHAR(128), transfertime BIGINT, timestamp BIGINT);
+CREATE TABLE IF NOT EXISTS DATASETS(id BIGINT AUTO_INCREMENT PRIMARY KEY, dataset VARCHAR(700) UNIQUE);
+CREATE TABLE IF NOT EXISTS BLOCKS(id BIGINT AUTO_INCREMENT PRIMARY KEY, block VARCHAR(700) UNIQUE);
+CREATE TABLE IF NOT EXISTS REQUESTS(id BIGINT AUTO_INCREMENT PRIMARY KEY, request TEXT, status VARCHAR(32), attempts INTEGER DEFAULT 0, error TEXT, bytes BIGINT DEFAULT 0, timestamp BIGINT);
+CREATE TABLE IF NOT EXISTS CHUNKS(id BIGINT AUTO_INCREMENT PRIMARY KEY, lfn VARCHAR(700), filehash VARCHAR(128), pos BIGINT, bytes BIGINT, hash VARCHAR(128), timestamp BIGINT, INDEX(lfn));
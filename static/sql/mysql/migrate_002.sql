@@ -0,0 +1,2 @@
+CREATE TABLE IF NOT EXISTS CHECKSUMS(id BIGINT AUTO_INCREMENT PRIMARY KEY, fileid BIGINT, type VARCHAR(32), hash VARCHAR(128), UNIQUE(fileid, type));
+ALTER TABLE FILES ADD COLUMN hashtype VARCHAR(32) DEFAULT 'adler32';
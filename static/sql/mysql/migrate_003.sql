@@ -0,0 +1 @@
+CREATE INDEX files_pfn ON FILES(pfn(255));
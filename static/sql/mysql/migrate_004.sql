@@ -0,0 +1 @@
+CREATE TABLE IF NOT EXISTS REPLICAS(id BIGINT AUTO_INCREMENT PRIMARY KEY, agent VARCHAR(64), url TEXT, dataset VARCHAR(700), block VARCHAR(700), files BIGINT, bytes BIGINT, timestamp BIGINT, UNIQUE(agent, block), INDEX(dataset));
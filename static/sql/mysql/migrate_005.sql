@@ -0,0 +1 @@
+CREATE TABLE IF NOT EXISTS TEMPDIRS(id BIGINT AUTO_INCREMENT PRIMARY KEY, dir VARCHAR(700) UNIQUE, timestamp BIGINT);
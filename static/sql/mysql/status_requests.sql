@@ -0,0 +1 @@
+UPDATE REQUESTS SET status=?, timestamp=? WHERE id=?
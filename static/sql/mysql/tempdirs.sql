@@ -0,0 +1 @@
+SELECT dir FROM TEMPDIRS ORDER BY dir
@@ -0,0 +1 @@
+UPDATE REQUESTS SET request=?, status=?, timestamp=? WHERE id=?
@@ -0,0 +1 @@
+UPDATE REQUESTS SET bytes=bytes+$1, timestamp=$2 WHERE id=$3
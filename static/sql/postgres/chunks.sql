@@ -0,0 +1 @@
+SELECT filehash, pos, bytes, hash FROM CHUNKS WHERE lfn=$1 ORDER BY pos
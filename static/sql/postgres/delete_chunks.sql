@@ -0,0 +1 @@
+DELETE FROM CHUNKS WHERE lfn=$1
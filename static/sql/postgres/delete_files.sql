@@ -0,0 +1 @@
+DELETE FROM FILES WHERE lfn=$1
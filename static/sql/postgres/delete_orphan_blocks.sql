@@ -0,0 +1 @@
+DELETE FROM BLOCKS WHERE id NOT IN (SELECT blockid FROM FILES)
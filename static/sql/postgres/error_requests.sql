@@ -0,0 +1 @@
+UPDATE REQUESTS SET status=$1, error=$2, timestamp=$3 WHERE id=$4
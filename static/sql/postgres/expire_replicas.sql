@@ -0,0 +1 @@
+DELETE FROM REPLICAS WHERE agent=$1 AND timestamp<$2
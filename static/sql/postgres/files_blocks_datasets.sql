@@ -0,0 +1,2 @@
+SELECT dataset, block, lfn, pfn, bytes, hash, hashtype
+FROM FILES AS F JOIN BLOCKS AS B ON F.BLOCKID=B.ID JOIN DATASETS AS D ON F.DATASETID = D.ID
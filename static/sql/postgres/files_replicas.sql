@@ -0,0 +1 @@
+SELECT files, bytes FROM REPLICAS WHERE agent=$1 AND block=$2
@@ -0,0 +1 @@
+SELECT id FROM DATASETS WHERE dataset=$1
@@ -0,0 +1 @@
+INSERT INTO BLOCKS(block) VALUES($1) ON CONFLICT DO NOTHING
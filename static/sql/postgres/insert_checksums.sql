@@ -0,0 +1 @@
+INSERT INTO CHECKSUMS(fileid, type, hash) VALUES($1,$2,$3) ON CONFLICT (fileid, type) DO UPDATE SET hash=EXCLUDED.hash
@@ -0,0 +1 @@
+INSERT INTO CHUNKS(lfn, filehash, pos, bytes, hash, timestamp) VALUES($1,$2,$3,$4,$5,$6)
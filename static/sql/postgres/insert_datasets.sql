@@ -0,0 +1 @@
+INSERT INTO DATASETS(dataset) VALUES($1) ON CONFLICT DO NOTHING
@@ -0,0 +1 @@
+INSERT INTO FILES(lfn, pfn, blockid, datasetid, bytes, hash, hashtype, transfertime, timestamp) VALUES($1,$2,$3,$4,$5,$6,$7,$8,$9)
@@ -0,0 +1,3 @@
+INSERT INTO REPLICAS(agent, url, dataset, block, files, bytes, timestamp) VALUES($1,$2,$3,$4,$5,$6,$7)
+ON CONFLICT(agent, block) DO UPDATE SET url=EXCLUDED.url, dataset=EXCLUDED.dataset, files=EXCLUDED.files, bytes=EXCLUDED.bytes, timestamp=EXCLUDED.timestamp
+WHERE EXCLUDED.timestamp>=REPLICAS.timestamp
@@ -0,0 +1 @@
+INSERT INTO REQUESTS(request, status, attempts, error, bytes, timestamp) VALUES($1,$2,0,'',0,$3) RETURNING id
@@ -0,0 +1 @@
+INSERT INTO TEMPDIRS(dir, timestamp) VALUES($1,$2) ON CONFLICT(dir) DO NOTHING
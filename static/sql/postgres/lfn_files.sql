@@ -0,0 +1 @@
+SELECT lfn FROM FILES WHERE pfn=$1
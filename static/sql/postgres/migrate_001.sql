@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS FILES(id BIGSERIAL PRIMARY KEY, lfn TEXT UNIQUE, pfn TEXT, blockid BIGINT, datasetid BIGINT, bytes BIGINT, hash TEXT, transfertime BIGINT, timestamp BIGINT);
+CREATE TABLE IF NOT EXISTS DATASETS(id BIGSERIAL PRIMARY KEY, dataset TEXT UNIQUE);
+CREATE TABLE IF NOT EXISTS BLOCKS(id BIGSERIAL PRIMARY KEY, block TEXT UNIQUE);
+CREATE TABLE IF NOT EXISTS REQUESTS(id BIGSERIAL PRIMARY KEY, request TEXT, status TEXT, attempts INTEGER DEFAULT 0, error TEXT DEFAULT '', bytes BIGINT DEFAULT 0, timestamp BIGINT);
+CREATE TABLE IF NOT EXISTS CHUNKS(id BIGSERIAL PRIMARY KEY, lfn TEXT, filehash TEXT, pos BIGINT, bytes BIGINT, hash TEXT, timestamp BIGINT);
+CREATE INDEX IF NOT EXISTS chunks_lfn ON CHUNKS(lfn);
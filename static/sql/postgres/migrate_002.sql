@@ -0,0 +1,2 @@
+CREATE TABLE IF NOT EXISTS CHECKSUMS(id BIGSERIAL PRIMARY KEY, fileid BIGINT, type TEXT, hash TEXT, UNIQUE(fileid, type));
+ALTER TABLE FILES ADD COLUMN IF NOT EXISTS hashtype TEXT DEFAULT 'adler32';
@@ -0,0 +1 @@
+CREATE INDEX IF NOT EXISTS files_pfn ON FILES(pfn);
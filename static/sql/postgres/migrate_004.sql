@@ -0,0 +1,2 @@
+CREATE TABLE IF NOT EXISTS REPLICAS(id BIGSERIAL PRIMARY KEY, agent TEXT, url TEXT, dataset TEXT, block TEXT, files BIGINT, bytes BIGINT, timestamp BIGINT, UNIQUE(agent, block));
+CREATE INDEX IF NOT EXISTS replicas_dataset ON REPLICAS(dataset);
@@ -0,0 +1 @@
+CREATE TABLE IF NOT EXISTS TEMPDIRS(id BIGSERIAL PRIMARY KEY, dir TEXT UNIQUE, timestamp BIGINT);
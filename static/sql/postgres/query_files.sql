@@ -0,0 +1,2 @@
+SELECT F.id AS fid, D.dataset AS dataset, B.block AS block, F.lfn AS lfn, F.pfn AS pfn, F.bytes AS bytes, F.hash AS hash, F.hashtype AS hashtype, F.transfertime AS transfertime, F.timestamp AS ts
+FROM FILES AS F JOIN BLOCKS AS B ON F.BLOCKID=B.ID JOIN DATASETS AS D ON F.DATASETID = D.ID
@@ -0,0 +1 @@
+SELECT id, request, status, attempts, error, bytes, timestamp FROM REQUESTS
@@ -0,0 +1 @@
+UPDATE REQUESTS SET status=$1, timestamp=$2 WHERE id=$3
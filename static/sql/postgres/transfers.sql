@@ -0,0 +1 @@
+SELECT bytes, transfertime FROM FILES
@@ -0,0 +1 @@
+UPDATE FILES SET pfn=$1, blockid=$2, datasetid=$3, bytes=$4, hash=$5, hashtype=$6, transfertime=$7, timestamp=$8 WHERE id=$9
@@ -0,0 +1 @@
+UPDATE REQUESTS SET request=$1, status=$2, timestamp=$3 WHERE id=$4
@@ -0,0 +1 @@
+UPDATE REQUESTS SET status=?, attempts=attempts+1, timestamp=? WHERE id=?
@@ -0,0 +1 @@
+UPDATE REQUESTS SET bytes=bytes+?, timestamp=? WHERE id=?
@@ -0,0 +1,2 @@
+SELECT lfn, type, C.hash
+FROM CHECKSUMS AS C JOIN FILES AS F ON C.FILEID=F.ID JOIN BLOCKS AS B ON F.BLOCKID=B.ID JOIN DATASETS AS D ON F.DATASETID = D.ID
@@ -0,0 +1 @@
+CREATE TABLE IF NOT EXISTS SCHEMA_VERSION(version INTEGER PRIMARY KEY, timestamp INTEGER)
@@ -0,0 +1 @@
+DELETE FROM CHECKSUMS WHERE fileid IN (SELECT id FROM FILES WHERE lfn=?)
@@ -0,0 +1 @@
+SELECT id FROM FILES WHERE lfn=?
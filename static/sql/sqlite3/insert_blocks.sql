@@ -1 +1 @@
-INSERT INTO BLOCKS(block) VALUES(?)
+INSERT OR IGNORE INTO BLOCKS(block) VALUES(?)
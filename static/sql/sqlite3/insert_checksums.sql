@@ -0,0 +1 @@
+INSERT OR REPLACE INTO CHECKSUMS(fileid, type, hash) VALUES(?,?,?)
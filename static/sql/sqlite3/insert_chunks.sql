@@ -0,0 +1 @@
+INSERT INTO CHUNKS(lfn, filehash, pos, bytes, hash, timestamp) VALUES(?,?,?,?,?,?)
@@ -1 +1 @@
-INSERT INTO DATASETS(dataset) VALUES(?)
+INSERT OR IGNORE INTO DATASETS(dataset) VALUES(?)
@@ -0,0 +1,3 @@
+INSERT INTO REPLICAS(agent, url, dataset, block, files, bytes, timestamp) VALUES(?,?,?,?,?,?,?)
+ON CONFLICT(agent, block) DO UPDATE SET url=excluded.url, dataset=excluded.dataset, files=excluded.files, bytes=excluded.bytes, timestamp=excluded.timestamp
+WHERE excluded.timestamp>=REPLICAS.timestamp
@@ -0,0 +1 @@
+INSERT OR IGNORE INTO TEMPDIRS(dir, timestamp) VALUES(?,?)
@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS FILES(id INTEGER PRIMARY KEY, lfn TEXT UNIQUE, pfn TEXT, blockid INTEGER, datasetid INTEGER, bytes INTEGER, hash TEXT, transfertime INTEGER, timestamp INTEGER);
+CREATE TABLE IF NOT EXISTS DATASETS(id INTEGER PRIMARY KEY, dataset TEXT UNIQUE);
+CREATE TABLE IF NOT EXISTS BLOCKS(id INTEGER PRIMARY KEY, block TEXT UNIQUE);
+CREATE TABLE IF NOT EXISTS REQUESTS(id INTEGER PRIMARY KEY, request TEXT, status TEXT, attempts INTEGER DEFAULT 0, error TEXT DEFAULT '', bytes INTEGER DEFAULT 0, timestamp INTEGER);
+CREATE TABLE IF NOT EXISTS CHUNKS(id INTEGER PRIMARY KEY, lfn TEXT, filehash TEXT, pos INTEGER, bytes INTEGER, hash TEXT, timestamp INTEGER);
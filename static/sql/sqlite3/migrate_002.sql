@@ -0,0 +1,2 @@
+CREATE TABLE IF NOT EXISTS CHECKSUMS(id INTEGER PRIMARY KEY, fileid INTEGER, type TEXT, hash TEXT, UNIQUE(fileid, type));
+ALTER TABLE FILES ADD COLUMN hashtype TEXT DEFAULT 'adler32';
@@ -0,0 +1,2 @@
+CREATE TABLE IF NOT EXISTS REPLICAS(id INTEGER PRIMARY KEY, agent TEXT, url TEXT, dataset TEXT, block TEXT, files INTEGER, bytes INTEGER, timestamp INTEGER, UNIQUE(agent, block));
+CREATE INDEX IF NOT EXISTS replicas_dataset ON REPLICAS(dataset);
@@ -0,0 +1 @@
+CREATE TABLE IF NOT EXISTS TEMPDIRS(id INTEGER PRIMARY KEY, dir TEXT UNIQUE, timestamp INTEGER);
@@ -0,0 +1 @@
+SELECT agent, url, dataset, block, files, bytes, timestamp FROM REPLICAS
@@ -0,0 +1 @@
+SELECT MAX(version) FROM SCHEMA_VERSION
@@ -0,0 +1 @@
+UPDATE FILES SET pfn=?, blockid=?, datasetid=?, bytes=?, hash=?, hashtype=?, transfertime=?, timestamp=? WHERE id=?
@@ -2,7 +2,7 @@
 
 set -e
 
-trap 'kill %1; kill %2' ERR EXIT
+trap 'kill %1; kill %2; kill %3' ERR EXIT
 
 ./transfer2go -config test/config/config1.json -auth=false >/dev/null 2>&1 &
 
@@ -12,4 +12,8 @@ sleep 1
 
 sleep 1
 
+./transfer2go -config test/config/config3.json -auth=false -agent http://localhost:8989 >/dev/null 2>&1 &
+
+sleep 1
+
 cd test && go test
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vkuznet/transfer2go/core"
+)
+
+// Construct arguments of backend tool from its options
+func TestToolArguments(t *testing.T) {
+	assert := assert.New(t)
+
+	args := core.ToolArgs{Pfn: "/data/my file.root", Rpfn: "/backend/store/my file.root", Lfn: "/store/my file.root", Hash: "0a1b2c3d", Type: "adler32"}
+	var tests = []struct {
+		description string
+		opts        string
+		expected    []string
+	}{
+		{"No options", "", []string{args.Pfn, args.Rpfn}},
+		{"Options without PFNs", "-f -v", []string{"-f", "-v", args.Pfn, args.Rpfn}},
+		{"Actions with spaces", "-f {{ .Pfn }} root://host/{{ .Lfn }}", []string{"-f", args.Pfn, "root://host/" + args.Lfn}},
+		{"Remote PFN only", "--dst {{$.Rpfn}}", []string{"--dst", args.Rpfn}},
+		{"Conditional action", "{{if .Hash}}--cksum {{.Type}}:{{.Hash}}{{end}} {{.Pfn}} {{.Rpfn}}", []string{"--cksum", "adler32:0a1b2c3d", args.Pfn, args.Rpfn}},
+	}
+	for _, test := range tests {
+		out, err := core.ToolArguments(test.opts, args)
+		assert.NoError(err, test.description)
+		assert.Equal(test.expected, out, test.description)
+	}
+
+	_, err := core.ToolArguments("-f {{.Pfn", args)
+	assert.Error(err, "Invalid template")
+}
+
+// Remove temporary files of interrupted transfers and keep resumable uploads
+func TestCleanTempFiles(t *testing.T) {
+	assert := assert.New(t)
+	defer initCatalog(t)()
+
+	dir, err := ioutil.TempDir("", "transfer2go")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	pfn := filepath.Join(dir, "store", "file.root")
+	assert.NoError(os.MkdirAll(filepath.Dir(pfn), 0755))
+	file, err := core.TempFile(pfn)
+	assert.NoError(err)
+	file.Close()
+	chunks, err := core.OpenChunkFile(pfn)
+	assert.NoError(err)
+	chunks.Close()
+	old := filepath.Join(dir, "store", "old.root")
+	expired, err := core.OpenChunkFile(old)
+	assert.NoError(err)
+	expired.Close()
+	mtime := time.Now().Add(-2 * core.ChunkExpire)
+	assert.NoError(os.Chtimes(core.ChunkFile(old), mtime, mtime))
+	// temporary files outside of upload directories are not scanned
+	other := filepath.Join(dir, ".other.root.t2gtmp")
+	assert.NoError(ioutil.WriteFile(other, []byte("data"), 0644))
+
+	count, failed, err := core.CleanTempFiles()
+	assert.NoError(err)
+	assert.Equal(2, count, "Removed files")
+	assert.Equal(0, failed, "Skipped paths")
+	_, err = os.Stat(file.Name())
+	assert.True(os.IsNotExist(err), "Temporary file is removed")
+	_, err = os.Stat(core.ChunkFile(old))
+	assert.True(os.IsNotExist(err), "Expired chunks are removed")
+	_, err = os.Stat(core.ChunkFile(pfn))
+	assert.NoError(err, "Chunks of resumable upload are kept")
+	_, err = os.Stat(other)
+	assert.NoError(err, "Other directories are not scanned")
+
+	// directory is forgotten once its uploads are completed
+	assert.NoError(os.Remove(core.ChunkFile(pfn)))
+	count, _, err = core.CleanTempFiles()
+	assert.NoError(err)
+	assert.Equal(0, count)
+	var dirs int
+	assert.NoError(core.DB.QueryRow("SELECT COUNT(*) FROM TEMPDIRS").Scan(&dirs))
+	assert.Equal(0, dirs, "Upload directories")
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/vkuznet/transfer2go/core"
+)
+
+// Report files which failed in bulk transfer sessions
+func TestBulkFailures(t *testing.T) {
+	assert := assert.New(t)
+	initMetrics()
+
+	// destination agent fails file bad.root, does not report result of
+	// lost.root and fails whole session which contains down.root
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reader, err := r.MultipartReader()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var results []core.TransferResult
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			io.Copy(ioutil.Discard, part)
+			lfn := part.Header.Get("Lfn")
+			switch filepath.Base(lfn) {
+			case "down.root":
+				http.Error(w, "session failed", http.StatusInternalServerError)
+				return
+			case "bad.root":
+				results = append(results, core.TransferResult{Lfn: lfn, Error: "checksum mismatch"})
+			case "lost.root":
+			default:
+				results = append(results, core.TransferResult{Lfn: lfn, Entry: core.CatalogEntry{Lfn: lfn, Pfn: "/backend" + lfn}})
+			}
+		}
+		json.NewEncoder(w).Encode(results)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "transfer2go")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	var records []core.CatalogEntry
+	for _, name := range []string{"ok1.root", "bad.root", "lost.root", "nofile.root", "ok2.root", "down.root"} {
+		pfn := filepath.Join(dir, name)
+		if name != "nofile.root" {
+			assert.NoError(ioutil.WriteFile(pfn, []byte("some\n"), 0644))
+		}
+		records = append(records, core.CatalogEntry{Lfn: "/a/b/c/" + name, Pfn: pfn, Dataset: "/a/b/c", Block: "/a/b/c#1", Bytes: 5})
+	}
+
+	bulkSize, chunkSize := core.BulkSize, core.ChunkSize
+	core.BulkSize, core.ChunkSize = 2, 0
+	defer func() { core.BulkSize, core.ChunkSize = bulkSize, chunkSize }()
+	tr := core.TransferRequest{Block: "/a/b/c#1", DstUrl: server.URL}
+	dstAgent := core.AgentStatus{Url: server.URL, Backend: "/backend"}
+	trRecords, err := core.HttpBackend{}.PutMany(records, &tr, core.AgentStatus{}, dstAgent)
+	if assert.Equal(1, len(trRecords), "Transferred files") {
+		assert.Equal("/a/b/c/ok1.root", trRecords[0].Lfn)
+		assert.Equal("/backend/a/b/c/ok1.root", trRecords[0].Pfn)
+	}
+	terr, ok := err.(*core.TransferError)
+	if assert.True(ok, "Transfer error") {
+		assert.Equal(len(records), terr.Total, "Files of transfer")
+		assert.Equal([]string{"/a/b/c/bad.root", "/a/b/c/lost.root", "/a/b/c/nofile.root", "/a/b/c/ok2.root", "/a/b/c/down.root"}, terr.Lfns, "Failed files")
+	}
+}
+
+// Helper function to initialize agent metrics updated by transfers
+func initMetrics() {
+	core.AgentMetrics = core.Metrics{In: metrics.NewCounter(), Failed: metrics.NewCounter(), Total: metrics.NewCounter(), TotalBytes: metrics.NewCounter(), Bytes: metrics.NewCounter()}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vkuznet/transfer2go/core"
+)
+
+// Add catalog entries in single transaction
+func TestCatalogAddMany(t *testing.T) {
+	assert := assert.New(t)
+	defer initCatalog(t)()
+
+	f1 := core.CatalogEntry{Lfn: "/a/b/c/f1.root", Pfn: "/data/f1.root", Dataset: "/a/b/c", Block: "/a/b/c#1", Bytes: 5, Hash: "0a1b2c3d"}
+	assert.NoError(core.TFC.Add(f1))
+
+	// DB rejects one of the entries in the middle of transaction
+	_, err := core.DB.Exec("CREATE TRIGGER reject_files BEFORE INSERT ON FILES WHEN NEW.lfn LIKE '%bad.root' BEGIN SELECT RAISE(ABORT, 'rejected file'); END")
+	assert.NoError(err)
+	update := f1
+	update.Bytes = 10
+	f2 := core.CatalogEntry{Lfn: "/a/b/d/f2.root", Pfn: "/data/f2.root", Dataset: "/a/b/d", Block: "/a/b/d#1", Bytes: 5}
+	bad := core.CatalogEntry{Lfn: "/a/b/d/bad.root", Pfn: "/data/bad.root", Dataset: "/a/b/d", Block: "/a/b/d#1", Bytes: 5}
+	invalid := core.CatalogEntry{Lfn: "/a/b/d/f3.root", Dataset: "/a/b/d"}
+
+	var tests = []struct {
+		description string
+		entries     []core.CatalogEntry
+		fails       bool
+		lfns        []string
+		bytes       int64
+	}{
+		{"Invalid entry", []core.CatalogEntry{update, f2, invalid}, true, []string{f1.Lfn}, 5},
+		{"Rejected entry", []core.CatalogEntry{update, f2, bad}, true, []string{f1.Lfn}, 5},
+		{"Valid entries", []core.CatalogEntry{update, f2}, false, []string{f1.Lfn, f2.Lfn}, 10},
+	}
+	for _, test := range tests {
+		err := core.TFC.AddMany(test.entries)
+		if test.fails {
+			assert.Error(err, test.description)
+		} else {
+			assert.NoError(err, test.description)
+		}
+		assert.Equal(test.lfns, core.TFC.Files("", "", ""), test.description)
+		records := core.TFC.Records(core.TransferRequest{File: f1.Lfn})
+		if assert.Equal(1, len(records), test.description) {
+			assert.Equal(test.bytes, records[0].Bytes, test.description)
+			assert.Equal(f1.Hash, records[0].Hash, test.description)
+		}
+		var datasets int
+		assert.NoError(core.DB.QueryRow("SELECT COUNT(*) FROM DATASETS").Scan(&datasets))
+		assert.Equal(len(test.lfns), datasets, test.description)
+	}
+}
+
+// Replace checksums of updated catalog entry
+func TestCatalogUpdateChecksums(t *testing.T) {
+	assert := assert.New(t)
+	defer initCatalog(t)()
+
+	rec := core.CatalogEntry{Lfn: "/a/b/c/f1.root", Pfn: "/data/f1.root", Dataset: "/a/b/c", Block: "/a/b/c#1", Bytes: 5, Checksums: map[string]string{"adler32": "00000001", "md5": "d41d8cd98f00b204e9800998ecf8427e"}}
+	assert.NoError(core.TFC.Add(rec))
+	rec.Hash = ""
+	rec.Checksums = map[string]string{"adler32": "00000002"}
+	assert.NoError(core.TFC.Add(rec))
+	records := core.TFC.Records(core.TransferRequest{File: rec.Lfn})
+	if assert.Equal(1, len(records)) {
+		assert.Equal(map[string]string{"adler32": "00000002"}, records[0].Checksums, "Checksums of updated entry")
+	}
+}
+
+// Delete catalog entries and report failures of their lookup
+func TestCatalogDelete(t *testing.T) {
+	assert := assert.New(t)
+	defer initCatalog(t)()
+	addQueryEntries(t)
+
+	records, err := core.TFC.Delete(core.TransferRequest{Block: "/a/b/c#1"})
+	assert.NoError(err)
+	assert.Equal(2, len(records), "Deleted entries")
+	assert.Equal(5, len(core.TFC.Files("", "", "")), "Remaining entries")
+	var checksums int
+	assert.NoError(core.DB.QueryRow("SELECT COUNT(*) FROM CHECKSUMS").Scan(&checksums))
+	assert.Equal(0, checksums, "Checksums of deleted entries")
+
+	_, err = core.DB.Exec("DROP TABLE CHECKSUMS")
+	assert.NoError(err)
+	_, err = core.TFC.Delete(core.TransferRequest{Dataset: "/data/x/y"})
+	assert.Error(err, "Lookup of entries fails")
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vkuznet/transfer2go/core"
+	"github.com/vkuznet/transfer2go/utils"
+)
+
+// Compute checksums of data stream
+func TestChecksums(t *testing.T) {
+	assert := assert.New(t)
+
+	sums, size, err := utils.Checksums(bytes.NewBufferString("abc"), utils.ChecksumAlgorithms()...)
+	assert.NoError(err)
+	assert.Equal(int64(3), size)
+	expected := map[string]string{
+		utils.Adler32: "024d0127",
+		utils.CRC32C:  "364b3fb7",
+		utils.MD5:     "900150983cd24fb0d6963f7d28e17f72",
+		utils.SHA256:  "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad",
+	}
+	assert.Equal(expected, sums)
+
+	_, _, err = utils.Checksums(bytes.NewBufferString("abc"), "sha1")
+	assert.Error(err, "Unsupported algorithm")
+}
+
+// Format and parse checksums of HTTP headers
+func TestParseChecksums(t *testing.T) {
+	assert := assert.New(t)
+
+	var tests = []struct {
+		description string
+		value       string
+		expected    map[string]string
+		fails       bool
+	}{
+		{"Empty value", "", map[string]string{}, false},
+		{"Single checksum", "adler32:024d0127", map[string]string{"adler32": "024d0127"}, false},
+		{"Mixed case and spaces", "ADLER32:024d0127, md5:900150983cd24fb0d6963f7d28e17f72", map[string]string{"adler32": "024d0127", "md5": "900150983cd24fb0d6963f7d28e17f72"}, false},
+		{"Malformed checksum", "adler32", nil, true},
+		{"Unsupported algorithm", "sha1:a9993e36", nil, true},
+	}
+	for _, test := range tests {
+		sums, err := utils.ParseChecksums(test.value)
+		if test.fails {
+			assert.Error(err, test.description)
+			continue
+		}
+		assert.NoError(err, test.description)
+		assert.Equal(test.expected, sums, test.description)
+		parsed, err := utils.ParseChecksums(utils.FormatChecksums(sums))
+		assert.NoError(err, test.description)
+		assert.Equal(sums, parsed, test.description)
+	}
+}
+
+// Verify received checksums against checksums of source agent
+func TestVerifyChecksums(t *testing.T) {
+	assert := assert.New(t)
+
+	computed := map[string]string{"adler32": "024d0127", "md5": "900150983cd24fb0d6963f7d28e17f72"}
+	assert.NoError(core.VerifyChecksums(map[string]string{"adler32": "024d0127"}, computed), "Matching checksum")
+	assert.NoError(core.VerifyChecksums(nil, computed), "No expected checksums")
+	assert.Error(core.VerifyChecksums(map[string]string{"adler32": "00000001"}, computed), "Mismatched checksum")
+	assert.Error(core.VerifyChecksums(map[string]string{"sha256": "ba7816bf"}, computed), "Checksum is not computed")
+
+	checksums := core.Checksums
+	core.Checksums = []string{"sha256"}
+	defer func() { core.Checksums = checksums }()
+	assert.Equal([]string{"md5", "adler32", "sha256"}, core.ChecksumTypes("md5", computed), "Checksums to compute")
+}
+
+// Read checksums of a file from HTTP headers
+func TestHeaderChecksums(t *testing.T) {
+	assert := assert.New(t)
+
+	h := make(http.Header)
+	h.Set("Hash", "024d0127")
+	h.Set("Checksums", "md5:900150983cd24fb0d6963f7d28e17f72")
+	hashType, sums, err := core.HeaderChecksums(h)
+	assert.NoError(err)
+	assert.Equal(utils.DefaultChecksum, hashType, "Default hash type")
+	assert.Equal(map[string]string{"adler32": "024d0127", "md5": "900150983cd24fb0d6963f7d28e17f72"}, sums)
+
+	h.Set("Hash-Type", "sha1")
+	_, _, err = core.HeaderChecksums(h)
+	assert.Error(err, "Unsupported hash type")
+
+	h.Set("Hash-Type", "MD5")
+	h.Set("Checksums", "md5")
+	_, _, err = core.HeaderChecksums(h)
+	assert.Error(err, "Malformed checksums")
+}
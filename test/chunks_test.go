@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vkuznet/transfer2go/core"
+)
+
+// Find chunks required to complete a file
+func TestMissingChunks(t *testing.T) {
+	assert := assert.New(t)
+
+	var tests = []struct {
+		description string
+		chunks      []core.ChunkInfo
+		missing     []core.ChunkInfo
+		offset      int64
+	}{
+		{"No stored chunks", nil, []core.ChunkInfo{{Offset: 0, Bytes: 4}, {Offset: 4, Bytes: 4}, {Offset: 8, Bytes: 2}}, 0},
+		{"Stored first chunk", []core.ChunkInfo{{Offset: 0, Bytes: 4}}, []core.ChunkInfo{{Offset: 4, Bytes: 4}, {Offset: 8, Bytes: 2}}, 4},
+		{"Gap between chunks", []core.ChunkInfo{{Offset: 0, Bytes: 4}, {Offset: 8, Bytes: 2}}, []core.ChunkInfo{{Offset: 4, Bytes: 4}}, 4},
+		{"Stored middle chunk", []core.ChunkInfo{{Offset: 4, Bytes: 4}}, []core.ChunkInfo{{Offset: 0, Bytes: 4}, {Offset: 8, Bytes: 2}}, 0},
+		{"All chunks stored", []core.ChunkInfo{{Offset: 0, Bytes: 4}, {Offset: 4, Bytes: 4}, {Offset: 8, Bytes: 2}}, nil, 10},
+	}
+	for _, test := range tests {
+		assert.Equal(test.missing, core.MissingChunks(test.chunks, 10, 4), test.description)
+		assert.Equal(test.offset, core.ResumeOffset(test.chunks), test.description)
+	}
+}
+
+// Discard chunks stored for another version of a file
+func TestStoredChunks(t *testing.T) {
+	assert := assert.New(t)
+	defer initCatalog(t)()
+
+	lfn := "/a/b/c/file.root"
+	assert.NoError(core.AddChunk(lfn, "v1", core.ChunkInfo{Offset: 0, Bytes: 4, Hash: "a"}))
+	assert.NoError(core.AddChunk(lfn, "v1", core.ChunkInfo{Offset: 4, Bytes: 4, Hash: "b"}))
+	chunks, err := core.StoredChunks(lfn, "v1")
+	assert.NoError(err)
+	assert.Equal(2, len(chunks), "Chunks of the same version")
+
+	chunks, err = core.StoredChunks(lfn, "v2")
+	assert.NoError(err)
+	assert.Empty(chunks, "Chunks of another version")
+	chunks, err = core.StoredChunks(lfn, "v1")
+	assert.NoError(err)
+	assert.Empty(chunks, "Discarded chunks")
+}
+
+// Resume chunked upload from chunks stored by destination agent
+func TestChunkResume(t *testing.T) {
+	assert := assert.New(t)
+	initMetrics()
+
+	dst := newChunkServer(core.ChunkInfo{Offset: 4, Bytes: 4})
+	server := httptest.NewServer(dst)
+	defer server.Close()
+	rec := chunkRecord(t, 10)
+	defer os.Remove(rec.Pfn)
+
+	chunkSize := core.ChunkSize
+	core.ChunkSize = 4
+	defer func() { core.ChunkSize = chunkSize }()
+	tr := core.TransferRequest{File: rec.Lfn, DstUrl: server.URL}
+	entry, err := core.HttpBackend{}.Put(rec, &tr, core.AgentStatus{}, core.AgentStatus{Url: server.URL})
+	assert.NoError(err)
+	assert.Equal("/backend"+rec.Lfn, entry.Pfn, "Completed upload")
+	assert.Equal([]int64{0, 8}, dst.uploaded(), "Uploaded chunks")
+}
+
+// Upload chunks within number of streams supported by both agents
+func TestChunkStreams(t *testing.T) {
+	assert := assert.New(t)
+	initMetrics()
+
+	chunkSize := core.ChunkSize
+	core.ChunkSize = 4
+	defer func() { core.ChunkSize = chunkSize }()
+	var tests = []struct {
+		description string
+		src         int
+		dst         int
+		streams     int
+	}{
+		{"Agents without streams", 0, 0, 1},
+		{"Destination supports fewer streams", 4, 2, 2},
+		{"Source supports fewer streams", 3, 8, 3},
+	}
+	for _, test := range tests {
+		dst := newChunkServer()
+		server := httptest.NewServer(dst)
+		rec := chunkRecord(t, 40)
+		tr := core.TransferRequest{File: rec.Lfn, DstUrl: server.URL}
+		_, err := core.HttpBackend{}.Put(rec, &tr, core.AgentStatus{Streams: test.src}, core.AgentStatus{Url: server.URL, Streams: test.dst})
+		assert.NoError(err, test.description)
+		assert.Equal(10, len(dst.uploaded()), test.description)
+		assert.Equal(test.streams, dst.maxStreams, test.description)
+		server.Close()
+		os.Remove(rec.Pfn)
+	}
+}
+
+// chunkServer emulates chunk uploads of destination agent, it completes the
+// upload once all chunks are received
+type chunkServer struct {
+	sync.Mutex
+	chunks     []core.ChunkInfo // stored chunks
+	offsets    []int64          // offsets of uploaded chunks
+	streams    int              // number of concurrent uploads
+	maxStreams int              // maximal number of concurrent uploads
+}
+
+// helper function to create chunk server with given stored chunks
+func newChunkServer(chunks ...core.ChunkInfo) *chunkServer {
+	return &chunkServer{chunks: chunks}
+}
+
+// ServeHTTP returns upload state on GET request and stores chunk on POST one
+func (s *chunkServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	state := core.UploadState{Lfn: r.FormValue("lfn")}
+	if r.Method == "POST" {
+		s.Lock()
+		s.streams++
+		if s.streams > s.maxStreams {
+			s.maxStreams = s.streams
+		}
+		s.Unlock()
+		time.Sleep(20 * time.Millisecond) // let other streams upload concurrently
+		offset, _ := strconv.ParseInt(r.Header.Get("Offset"), 10, 64)
+		total, _ := strconv.ParseInt(r.Header.Get("Bytes"), 10, 64)
+		data, _ := ioutil.ReadAll(r.Body)
+		s.Lock()
+		s.streams--
+		s.offsets = append(s.offsets, offset)
+		s.chunks = append(s.chunks, core.ChunkInfo{Offset: offset, Bytes: int64(len(data))})
+		sort.Slice(s.chunks, func(i, j int) bool { return s.chunks[i].Offset < s.chunks[j].Offset })
+		state.Lfn = r.Header.Get("Lfn")
+		if len(core.MissingChunks(s.chunks, total, total)) == 0 {
+			state.Entry = &core.CatalogEntry{Lfn: state.Lfn, Pfn: "/backend" + state.Lfn, Bytes: total}
+		}
+		s.Unlock()
+	}
+	s.Lock()
+	state.Chunks = append(state.Chunks, s.chunks...)
+	s.Unlock()
+	json.NewEncoder(w).Encode(state)
+}
+
+// helper function to return sorted offsets of uploaded chunks
+func (s *chunkServer) uploaded() []int64 {
+	s.Lock()
+	defer s.Unlock()
+	out := append([]int64{}, s.offsets...)
+	sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+	return out
+}
+
+// helper function to create catalog entry of temporary file of given size
+func chunkRecord(t *testing.T, bytes int) core.CatalogEntry {
+	file, err := ioutil.TempFile("", "transfer2go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	for i := 0; i < bytes; i++ {
+		fmt.Fprintf(file, "%d", i%10)
+	}
+	lfn := "/a/b/c/" + filepath.Base(file.Name())
+	return core.CatalogEntry{Lfn: lfn, Pfn: file.Name(), Dataset: "/a/b/c", Block: "/a/b/c#1", Bytes: int64(bytes), Hash: "0a1b2c3d", HashType: "adler32"}
+}
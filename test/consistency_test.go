@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vkuznet/transfer2go/core"
+)
+
+// Check catalog entries against storage and find orphaned files
+func TestConsistencyCheck(t *testing.T) {
+	assert := assert.New(t)
+	defer initCatalog(t)()
+
+	// storage directory is within working directory to register relative PFNs
+	dir, err := ioutil.TempDir(".", "storage")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	abs, err := filepath.Abs(dir)
+	assert.NoError(err)
+	for _, name := range []string{"good.root", "relative.root", "corrupt.root", "orphan.root", "transfer.root" + core.TempSuffix} {
+		assert.NoError(ioutil.WriteFile(filepath.Join(dir, name), []byte("some\n"), 0644))
+	}
+	var tests = []struct {
+		lfn   string
+		pfn   string
+		bytes int64
+	}{
+		{"/a/b/c/good.root", filepath.Join(abs, "good.root"), 5},
+		{"/a/b/c/relative.root", filepath.Join(dir, "relative.root"), 5},
+		{"/a/b/c/corrupt.root", filepath.Join(abs, "corrupt.root"), 10},
+		{"/a/b/c/missing.root", filepath.Join(abs, "missing.root"), 5},
+	}
+	for _, test := range tests {
+		rec := core.CatalogEntry{Lfn: test.lfn, Pfn: test.pfn, Bytes: test.bytes, Dataset: "/a/b/c", Block: "/a/b/c#1"}
+		assert.NoError(core.TFC.Add(rec), test.lfn)
+	}
+
+	// unreadable directory does not stop the check
+	denied := filepath.Join(dir, "denied")
+	assert.NoError(os.Mkdir(denied, 0755))
+	assert.NoError(ioutil.WriteFile(filepath.Join(denied, "hidden.root"), []byte("some\n"), 0644))
+	assert.NoError(os.Chmod(denied, 0))
+	defer os.Chmod(denied, 0755)
+	errors := int64(1)
+	if _, err := ioutil.ReadDir(denied); err == nil {
+		errors = 0 // permissions are not enforced, e.g. for root
+	}
+
+	maxProblems := core.MaxProblems
+	core.MaxProblems = 2
+	defer func() { core.MaxProblems = maxProblems }()
+	report := runConsistencyCheck(t, core.ConsistencyCheck{Dir: abs, Quick: true})
+	assert.Equal("", report.Error, "Check error")
+	assert.Equal(int64(4), report.Files, "Checked entries")
+	assert.Equal(int64(1), report.Missing, "Missing files")
+	assert.Equal(int64(1), report.Corrupt, "Corrupt files")
+	assert.Equal(1+1-errors, report.Orphans, "Orphaned files")
+	assert.Equal(errors, report.Errors, "Unreadable paths")
+	assert.Equal(5-errors, report.Scanned, "Scanned files")
+	assert.Equal(2, len(report.Problems), "Listed problems")
+
+	// problems are listed up to MaxProblems while all of them are counted
+	core.MaxProblems = 10
+	report = runConsistencyCheck(t, core.ConsistencyCheck{Dir: dir, Quick: true})
+	assert.Equal(int(report.Missing+report.Corrupt+report.Orphans+report.Errors), len(report.Problems), "Listed problems")
+	for _, p := range report.Problems {
+		if p.Status == core.FileOrphan {
+			assert.Contains([]string{"orphan.root", "hidden.root"}, filepath.Base(p.Pfn), "Orphaned file")
+		}
+	}
+}
+
+// Queue repairs of bad files without waiting for their transfers
+func TestConsistencyRepair(t *testing.T) {
+	assert := assert.New(t)
+	defer initCatalog(t)()
+
+	dir, err := ioutil.TempDir("", "transfer2go")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"good.root", "corrupt.root"} {
+		assert.NoError(ioutil.WriteFile(filepath.Join(dir, name), []byte("some\n"), 0644))
+	}
+	for _, rec := range []core.CatalogEntry{
+		{Lfn: "/a/b/c/good.root", Pfn: filepath.Join(dir, "good.root"), Bytes: 5},
+		{Lfn: "/a/b/c/corrupt.root", Pfn: filepath.Join(dir, "corrupt.root"), Bytes: 10},
+		{Lfn: "/a/b/c/missing.root", Pfn: filepath.Join(dir, "missing.root"), Bytes: 5},
+		{Lfn: "/a/b/c/lost.root", Pfn: filepath.Join(dir, "lost.root"), Bytes: 5},
+	} {
+		rec.Dataset = "/a/b/c"
+		rec.Block = "/a/b/c#1"
+		assert.NoError(core.TFC.Add(rec), rec.Lfn)
+	}
+	// missing file is already transferred by request of previous check
+	pending := core.TransferRequest{File: "/a/b/c/missing.root", Mode: core.PullMode}
+	assert.NoError(pending.Persist(core.RequestQueued))
+
+	var repaired []string
+	repair := func(rec core.CatalogEntry, p core.FileProblem) (int64, string, error) {
+		repaired = append(repaired, rec.Lfn)
+		if rec.Lfn == "/a/b/c/lost.root" {
+			return 0, "", fmt.Errorf("no replica")
+		}
+		return 100, "queued", nil
+	}
+	report := runConsistencyCheck(t, core.ConsistencyCheck{Quick: true, Repair: repair})
+	assert.Equal("", report.Error, "Check error")
+	assert.ElementsMatch([]string{"/a/b/c/corrupt.root", "/a/b/c/lost.root"}, repaired, "Repaired files")
+	assert.Equal(int64(2), report.Repairs, "Repair requests")
+	assert.ElementsMatch([]int64{100, pending.Id}, report.Requests, "Repair request ids")
+	requests := make(map[string]int64)
+	for _, p := range report.Problems {
+		requests[p.Lfn] = p.Request
+	}
+	assert.Equal(map[string]int64{"/a/b/c/corrupt.root": 100, "/a/b/c/missing.root": pending.Id, "/a/b/c/lost.root": 0}, requests, "Repair requests of files")
+}
+
+// Helper function to run consistency check and wait for its report
+func runConsistencyCheck(t *testing.T, c core.ConsistencyCheck) core.ConsistencyReport {
+	if !c.Start() {
+		t.Fatal("consistency check is already running")
+	}
+	for i := 0; i < 100; i++ {
+		running, report := core.ConsistencyStatus()
+		if !running && report != nil {
+			return *report
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal("consistency check did not finish")
+	return core.ConsistencyReport{}
+}
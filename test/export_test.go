@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vkuznet/transfer2go/core"
+)
+
+// Export catalog and import it into another one
+func TestCatalogExport(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, format := range []string{core.ExportJSON, core.ExportCSV} {
+		cleanup := initCatalog(t)
+		addQueryEntries(t)
+		quoted := core.CatalogEntry{Lfn: "/store/quoted.root", Pfn: `/data/a "b", c.root`, Dataset: "/a/b/c", Block: "/a/b/c#1", Bytes: 1, Hash: "00000001", TransferTime: 3, Timestamp: 108}
+		assert.NoError(core.TFC.Add(quoted))
+		expected := queryEntries(t)
+		var dump bytes.Buffer
+		assert.NoError(core.TFC.Export(&dump, format, core.CatalogQuery{}), format)
+		cleanup()
+
+		cleanup = initCatalog(t)
+		var entries []core.CatalogEntry
+		err := core.ReadEntries(bytes.NewReader(dump.Bytes()), format, func(rec core.CatalogEntry) error {
+			entries = append(entries, rec)
+			return nil
+		})
+		assert.NoError(err, format)
+		assert.NoError(core.TFC.AddMany(entries), format)
+		assert.Equal(expected, queryEntries(t), format)
+		var again bytes.Buffer
+		assert.NoError(core.TFC.Export(&again, format, core.CatalogQuery{}), format)
+		assert.Equal(dump.String(), again.String(), format)
+		cleanup()
+	}
+
+	assert.Error(core.TFC.Export(&bytes.Buffer{}, "xml", core.CatalogQuery{}), "Unsupported export format")
+	assert.Error(core.ReadEntries(strings.NewReader(""), "xml", nil), "Unsupported import format")
+}
+
+// Read catalog entries of CSV files produced by other tools
+func TestReadCSVEntries(t *testing.T) {
+	assert := assert.New(t)
+
+	data := "lfn,dataset,block,bytes,checksums,extra\n/store/f1.root,/a/b/c,/a/b/c#1,10,adler32:00000001,x\n/store/f2.root,/a/b/c,/a/b/c#1\n"
+	var entries []core.CatalogEntry
+	err := core.ReadEntries(strings.NewReader(data), core.ExportCSV, func(rec core.CatalogEntry) error {
+		entries = append(entries, rec)
+		return nil
+	})
+	assert.NoError(err)
+	if assert.Equal(2, len(entries)) {
+		assert.Equal(core.CatalogEntry{Lfn: "/store/f1.root", Dataset: "/a/b/c", Block: "/a/b/c#1", Bytes: 10, Checksums: map[string]string{"adler32": "00000001"}}, entries[0], "Reordered columns")
+		assert.Equal(core.CatalogEntry{Lfn: "/store/f2.root", Dataset: "/a/b/c", Block: "/a/b/c#1"}, entries[1], "Missing columns")
+	}
+
+	data = "lfn,bytes\n/store/f1.root,10\n/store/f2.root,ten\n"
+	err = core.ReadEntries(strings.NewReader(data), core.ExportCSV, func(rec core.CatalogEntry) error { return nil })
+	if assert.Error(err, "Invalid size") {
+		assert.Contains(err.Error(), "line 3")
+	}
+}
+
+// helper function to return all catalog entries ordered by LFN
+func queryEntries(t *testing.T) []core.CatalogEntry {
+	var out []core.CatalogEntry
+	_, err := core.TFC.Query(core.CatalogQuery{}, func(rec core.CatalogEntry) error {
+		out = append(out, rec)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
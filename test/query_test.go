@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vkuznet/transfer2go/core"
+)
+
+// Match catalog entries by wildcard patterns and filters
+func TestCatalogQuery(t *testing.T) {
+	defer initCatalog(t)()
+	addQueryEntries(t)
+	checkCatalogQuery(t)
+}
+
+// Page through catalog entries with cursors
+func TestCatalogPages(t *testing.T) {
+	defer initCatalog(t)()
+	addQueryEntries(t)
+	checkCatalogPages(t)
+}
+
+// helper function to check queries of catalog entries added by
+// addQueryEntries
+func checkCatalogQuery(t *testing.T) {
+	assert := assert.New(t)
+
+	var tests = []struct {
+		description string
+		query       core.CatalogQuery
+		lfns        []string
+	}{
+		{"Exact LFN", core.CatalogQuery{Lfn: "/store/a_b/f1.root"}, []string{"/store/a_b/f1.root"}},
+		{"Underscore is not a wildcard", core.CatalogQuery{Lfn: "/store/a_b/*"}, []string{"/store/a_b/f1.root"}},
+		{"Percent is not a wildcard", core.CatalogQuery{Lfn: "/store/a%b/*"}, []string{"/store/a%b/f3.root"}},
+		{"Escape character", core.CatalogQuery{Lfn: "/store/a!b/*"}, []string{"/store/a!b/f4.root"}},
+		{"Wildcard in the middle", core.CatalogQuery{Lfn: "/store/*/f2.root"}, []string{"/store/aXb/f2.root"}},
+		{"Dataset pattern", core.CatalogQuery{Dataset: "/data/*", Sort: "-lfn"}, []string{"/store/data/f7.root", "/store/data/f6.root", "/store/data/f5.root"}},
+		{"Size range", core.CatalogQuery{MinBytes: 20, MaxBytes: 30, Sort: "bytes"}, []string{"/store/a%b/f3.root", "/store/data/f6.root", "/store/a!b/f4.root"}},
+		{"Time range", core.CatalogQuery{MinTime: 105, Sort: "-timestamp"}, []string{"/store/data/f7.root", "/store/data/f6.root", "/store/data/f5.root"}},
+	}
+	for _, test := range tests {
+		assert.NoError(test.query.Validate(), test.description)
+		lfns, cursor := queryLfns(t, test.query)
+		assert.Equal(test.lfns, lfns, test.description)
+		assert.Equal("", cursor, test.description)
+	}
+
+	// entries are returned once with all their checksums
+	var records []core.CatalogEntry
+	_, err := core.TFC.Query(core.CatalogQuery{Lfn: "/store/a_b/*"}, func(rec core.CatalogEntry) error {
+		records = append(records, rec)
+		return nil
+	})
+	assert.NoError(err)
+	if assert.Equal(1, len(records), "Entry with checksums") {
+		assert.Equal(map[string]string{"adler32": "00000001", "md5": "d41d8cd98f00b204e9800998ecf8427e"}, records[0].Checksums)
+	}
+}
+
+// helper function to check pages of catalog entries added by
+// addQueryEntries
+func checkCatalogPages(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, sort := range []string{"lfn", "-lfn", "bytes", "-bytes", "timestamp", "block", "-dataset"} {
+		all, _ := queryLfns(t, core.CatalogQuery{Sort: sort})
+		assert.Equal(7, len(all), sort)
+		var pages []string
+		q := core.CatalogQuery{Sort: sort, Limit: 2}
+		for i := 0; i < 10; i++ {
+			lfns, cursor := queryLfns(t, q)
+			assert.True(len(lfns) <= q.Limit, sort)
+			pages = append(pages, lfns...)
+			if cursor == "" {
+				break
+			}
+			q.Cursor = cursor
+			assert.NoError(q.Validate(), sort)
+		}
+		assert.Equal(all, pages, fmt.Sprintf("Pages sorted by %s", sort))
+	}
+
+	for _, q := range []core.CatalogQuery{{Sort: "pfn"}, {Limit: -1}, {Cursor: "invalid"}} {
+		assert.Error(q.Validate(), q.String())
+	}
+}
+
+// helper function to add catalog entries used by query tests, sizes and
+// timestamps of some entries are equal to check order of pages
+func addQueryEntries(t *testing.T) {
+	entries := []core.CatalogEntry{
+		{Lfn: "/store/a_b/f1.root", Dataset: "/a/b/c", Block: "/a/b/c#1", Bytes: 10, Timestamp: 101, Checksums: map[string]string{"adler32": "00000001", "md5": "d41d8cd98f00b204e9800998ecf8427e"}},
+		{Lfn: "/store/aXb/f2.root", Dataset: "/a/b/c", Block: "/a/b/c#1", Bytes: 10, Timestamp: 102},
+		{Lfn: "/store/a%b/f3.root", Dataset: "/a/b/c", Block: "/a/b/c#2", Bytes: 20, Timestamp: 103},
+		{Lfn: "/store/a!b/f4.root", Dataset: "/a/b/c", Block: "/a/b/c#2", Bytes: 30, Timestamp: 104},
+		{Lfn: "/store/data/f5.root", Dataset: "/data/x/y", Block: "/data/x/y#1", Bytes: 40, Timestamp: 105},
+		{Lfn: "/store/data/f6.root", Dataset: "/data/x/y", Block: "/data/x/y#1", Bytes: 20, Timestamp: 106},
+		{Lfn: "/store/data/f7.root", Dataset: "/data/x/y", Block: "/data/x/y#1", Bytes: 50, Timestamp: 107},
+	}
+	for i := range entries {
+		entries[i].Pfn = "/data" + entries[i].Lfn
+	}
+	if err := core.TFC.AddMany(entries); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// helper function to return LFNs of entries matching given query and cursor
+// of the next page
+func queryLfns(t *testing.T, q core.CatalogQuery) ([]string, string) {
+	var lfns []string
+	cursor, err := core.TFC.Query(q, func(rec core.CatalogEntry) error {
+		lfns = append(lfns, rec.Lfn)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lfns, cursor
+}
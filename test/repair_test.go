@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vkuznet/transfer2go/core"
+	"github.com/vkuznet/transfer2go/utils"
+)
+
+// Replace corrupt file by verified replica of another agent
+func TestRepairReplace(t *testing.T) {
+	assert := assert.New(t)
+	defer initCatalog(t)()
+
+	dir, err := ioutil.TempDir("", "transfer2go")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	srcAgent := core.AgentStatus{Protocol: "posix", Backend: filepath.Join(dir, "src")}
+	dstAgent := core.AgentStatus{Protocol: "posix", Backend: filepath.Join(dir, "dst")}
+	lfn := "/a/b/c/file.root"
+	src := filepath.Join(srcAgent.Backend, lfn)
+	dst := filepath.Join(dstAgent.Backend, lfn)
+	assert.NoError(os.MkdirAll(filepath.Dir(src), 0755))
+	assert.NoError(os.MkdirAll(filepath.Dir(dst), 0755))
+	assert.NoError(ioutil.WriteFile(src, []byte("some\n"), 0644))
+	assert.NoError(ioutil.WriteFile(dst, []byte("bad\n"), 0644))
+	sums, size, err := utils.Checksums(bytes.NewBufferString("some\n"), utils.DefaultChecksum)
+	assert.NoError(err)
+	rec := core.CatalogEntry{Lfn: lfn, Pfn: src, Dataset: "/a/b/c", Block: "/a/b/c#1", Bytes: size, HashType: utils.DefaultChecksum}
+	rec.SetChecksums(sums)
+	backend := core.GetBackend("posix")
+
+	var tests = []struct {
+		description string
+		repair      bool
+		hash        string
+		content     string
+		fails       bool
+	}{
+		{"Transfer refuses to overwrite corrupt file", false, sums[utils.DefaultChecksum], "bad\n", true},
+		{"Corrupt file is kept unless replica is verified", true, "00000000", "bad\n", true},
+		{"Corrupt file is replaced by verified replica", true, sums[utils.DefaultChecksum], "some\n", false},
+	}
+	for _, test := range tests {
+		c := rec
+		c.SetChecksums(map[string]string{utils.DefaultChecksum: test.hash})
+		tr := core.TransferRequest{File: lfn, Mode: core.PullMode, Repair: test.repair}
+		_, err := backend.Get(c, &tr, srcAgent, dstAgent)
+		if test.fails {
+			assert.Error(err, test.description)
+		} else {
+			assert.NoError(err, test.description)
+		}
+		data, err := ioutil.ReadFile(dst)
+		assert.NoError(err, test.description)
+		assert.Equal(test.content, string(data), test.description)
+		files, err := filepath.Glob(filepath.Join(filepath.Dir(dst), "*"+core.TempSuffix))
+		assert.NoError(err)
+		assert.Empty(files, test.description)
+	}
+
+	// file is repaired in PFN of its catalog entry rather than PFN of rules
+	pfn := filepath.Join(dir, "old", "file.root")
+	assert.NoError(os.MkdirAll(filepath.Dir(pfn), 0755))
+	assert.NoError(ioutil.WriteFile(pfn, []byte("bad\n"), 0644))
+	assert.NoError(os.Remove(dst))
+	tr := core.TransferRequest{File: lfn, Mode: core.PullMode, Repair: true, Pfn: pfn}
+	entry, err := backend.Get(rec, &tr, srcAgent, dstAgent)
+	assert.NoError(err)
+	assert.Equal(pfn, entry.Pfn, "Repaired PFN")
+	data, err := ioutil.ReadFile(pfn)
+	assert.NoError(err)
+	assert.Equal("some\n", string(data), "Repaired file")
+	_, err = os.Stat(dst)
+	assert.True(os.IsNotExist(err), "File is not written into PFN of rules")
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vkuznet/transfer2go/core"
+)
+
+// Merge replicas of transferred files with replica index
+func TestRecordReplicas(t *testing.T) {
+	assert := assert.New(t)
+	defer initCatalog(t)()
+
+	f1 := core.CatalogEntry{Lfn: "/a/b/c/f1.root", Dataset: "/a/b/c", Block: "/a/b/c#1", Bytes: 10}
+	f2 := core.CatalogEntry{Lfn: "/a/b/c/f2.root", Dataset: "/a/b/c", Block: "/a/b/c#1", Bytes: 20}
+	f3 := core.CatalogEntry{Lfn: "/a/b/c/f3.root", Dataset: "/a/b/c", Block: "/a/b/c#2", Bytes: 30}
+	var tests = []struct {
+		description string
+		records     []core.CatalogEntry
+		retry       bool
+		files       int64
+		bytes       int64
+	}{
+		{"First attempt transfers part of the block", []core.CatalogEntry{f1}, false, 1, 10},
+		{"Retry completes the block", []core.CatalogEntry{f2}, true, 2, 30},
+		{"New request transfers fewer files", []core.CatalogEntry{f1, f3}, false, 2, 30},
+	}
+	for _, test := range tests {
+		assert.NoError(core.RecordReplicas("A2", "http://a2", test.records, test.retry), test.description)
+		replicas, err := core.Replicas("A2", "", "/a/b/c#1")
+		assert.NoError(err, test.description)
+		if assert.Equal(1, len(replicas), test.description) {
+			assert.Equal(test.files, replicas[0].Files, test.description)
+			assert.Equal(test.bytes, replicas[0].Bytes, test.description)
+		}
+	}
+	replicas, err := core.Replicas("A2", "/a/b/*", "")
+	assert.NoError(err)
+	assert.Equal(2, len(replicas), "Replicas of dataset")
+}
+
+// Apply replica gossip of other agents
+func TestReplicaGossip(t *testing.T) {
+	assert := assert.New(t)
+	defer initCatalog(t)()
+
+	b1 := core.Replica{Dataset: "/a/b/c", Block: "/a/b/c#1", Files: 2, Bytes: 30}
+	b2 := core.Replica{Dataset: "/a/b/c", Block: "/a/b/c#2", Files: 1, Bytes: 30}
+	g := core.ReplicaGossip{Agent: "A2", Timestamp: 100, Blocks: []core.Replica{b1, b2}}
+	assert.NoError(g.Apply("A1"))
+	replicas, err := core.Replicas("A2", "", "")
+	assert.NoError(err)
+	assert.Equal(2, len(replicas), "Blocks of sending agent")
+
+	// block deleted by the agent is removed from the index
+	g = core.ReplicaGossip{Agent: "A2", Timestamp: 200, Blocks: []core.Replica{b1}}
+	assert.NoError(g.Apply("A1"))
+	replicas, err = core.Replicas("A2", "", "")
+	assert.NoError(err)
+	if assert.Equal(1, len(replicas), "Deleted block") {
+		assert.Equal(b1.Block, replicas[0].Block)
+		assert.Equal(int64(200), replicas[0].Timestamp)
+	}
+
+	// outdated gossip does not override recent confirmation
+	g = core.ReplicaGossip{Agent: "A2", Timestamp: 150, Blocks: []core.Replica{{Dataset: "/a/b/c", Block: "/a/b/c#1", Files: 1, Bytes: 10}}}
+	assert.NoError(g.Apply("A1"))
+	replicas, err = core.Replicas("A2", "", "")
+	assert.NoError(err)
+	if assert.Equal(1, len(replicas), "Outdated gossip") {
+		assert.Equal(b1.Files, replicas[0].Files)
+	}
+
+	g = core.ReplicaGossip{Agent: "A1", Timestamp: 300, Blocks: []core.Replica{b1}}
+	assert.Error(g.Apply("A1"), "Gossip of the agent itself")
+}
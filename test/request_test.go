@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
@@ -207,6 +208,148 @@ func TestTransferRequest(t *testing.T) {
 
 }
 
+// Transfer file from test3 to test2 using posix protocol
+func TestPosixTransferRequest(t *testing.T) {
+	assert := assert.New(t)
+
+	test := tests{
+		description:        "Transfer file using posix protocol",
+		url:                "http://localhost:8001/request",
+		expectedStatusCode: 200,
+		expectedBody:       "some\n",
+	}
+
+	err := createFile("data/posix.txt")
+	assert.NoError(err)
+	defer deleteFile("data/posix.txt")
+
+	records := []core.CatalogEntry{{Lfn: "posix.root", Pfn: "test/data/posix.txt", Block: "/a/b/c#456", Dataset: "/a/b/c", Bytes: 5}}
+	d, err := json.Marshal(records)
+	assert.NoError(err)
+	resp := utils.FetchResponse("http://localhost:8001/tfc", d)
+	assert.Equal(test.expectedStatusCode, resp.StatusCode, test.description)
+
+	req := core.TransferRequest{SrcUrl: "http://localhost:8001", SrcAlias: "Test3", File: "posix.root", DstUrl: "http://localhost:8000", DstAlias: "Test2"}
+	d, err = json.Marshal([]core.TransferRequest{req})
+	assert.NoError(err)
+	resp = utils.FetchResponse(test.url, d)
+	assert.Equal(test.expectedStatusCode, resp.StatusCode, test.description)
+	time.Sleep(time.Second * 2)
+
+	data, err := ioutil.ReadFile("posix.root")
+	assert.NoError(err)
+	assert.Equal(test.expectedBody, string(data), test.description)
+	err = deleteFile("posix.root")
+	assert.NoError(err)
+}
+
+// Check status of submitted transfer requests
+func TestRequestStatus(t *testing.T) {
+	assert := assert.New(t)
+
+	test := tests{
+		description:        "Get status of transfer requests",
+		url:                url + "/request",
+		expectedStatusCode: 200,
+		expectedBody:       "file.root",
+	}
+
+	var data []core.RequestRecord
+
+	resp, err := http.Get(test.url)
+	assert.NoError(err)
+	actual, err := ioutil.ReadAll(resp.Body)
+
+	defer resp.Body.Close()
+	err = json.Unmarshal([]byte(actual), &data)
+	assert.NoError(err)
+
+	assert.Equal(test.expectedStatusCode, resp.StatusCode, test.description)
+	assert.NotEmpty(data, test.description)
+	rec := data[len(data)-1]
+	assert.Equal(test.expectedBody, rec.Request.File, test.description)
+
+	// look-up the same request by its id
+	resp, err = http.Get(fmt.Sprintf("%s?id=%d", test.url, rec.Id))
+	assert.NoError(err)
+	defer resp.Body.Close()
+	var r core.RequestRecord
+	err = json.NewDecoder(resp.Body).Decode(&r)
+	assert.NoError(err)
+	assert.Equal(rec.Id, r.Id, test.description)
+}
+
+// Cancel unknown transfer request
+func TestRequestCancel(t *testing.T) {
+	assert := assert.New(t)
+
+	test := tests{
+		description:        "Cancel unknown transfer request",
+		url:                url + "/request?id=999999",
+		expectedStatusCode: 404,
+		expectedBody:       "",
+	}
+
+	req, err := http.NewRequest("DELETE", test.url, nil)
+	assert.NoError(err)
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(err)
+	defer resp.Body.Close()
+	assert.Equal(test.expectedStatusCode, resp.StatusCode, test.description)
+}
+
+// Cancel paused transfer request, its file should not reach destination
+func TestRequestCancelPaused(t *testing.T) {
+	assert := assert.New(t)
+
+	test := tests{
+		description:        "Cancel paused transfer request",
+		url:                url + "/request",
+		expectedStatusCode: 200,
+		expectedBody:       core.RequestCancelled,
+	}
+
+	err := createFile("data/testdata.txt")
+	assert.NoError(err)
+	defer deleteFile("data/testdata.txt")
+
+	req := core.TransferRequest{SrcUrl: "http://localhost:8989", SrcAlias: "Test", File: "file.root", DstUrl: "http://localhost:8000", DstAlias: "Test2", Delay: 2}
+	d, err := json.Marshal([]core.TransferRequest{req})
+	assert.NoError(err)
+	resp := utils.FetchResponse(test.url, d)
+	assert.Equal(test.expectedStatusCode, resp.StatusCode, test.description)
+	var accepted []core.TransferRequest
+	err = json.Unmarshal(resp.Data, &accepted)
+	assert.NoError(err)
+	if !assert.Len(accepted, 1, test.description) {
+		return
+	}
+	rid := accepted[0].Id
+
+	// cancel request while it is paused by a worker
+	time.Sleep(time.Millisecond * 500)
+	r, err := http.NewRequest("DELETE", fmt.Sprintf("%s?id=%d", test.url, rid), nil)
+	assert.NoError(err)
+	rsp, err := http.DefaultClient.Do(r)
+	assert.NoError(err)
+	rsp.Body.Close()
+	assert.Equal(test.expectedStatusCode, rsp.StatusCode, test.description)
+
+	// wait until pause is over and check that nothing was transferred
+	time.Sleep(time.Second * 3)
+	_, err = os.Stat("file.root")
+	assert.True(os.IsNotExist(err), test.description)
+
+	rsp, err = http.Get(fmt.Sprintf("%s?id=%d", test.url, rid))
+	assert.NoError(err)
+	defer rsp.Body.Close()
+	var rec core.RequestRecord
+	err = json.NewDecoder(rsp.Body).Decode(&rec)
+	assert.NoError(err)
+	assert.Equal(test.expectedBody, rec.Status, test.description)
+	assert.Equal(0, rec.Attempts, test.description)
+}
+
 // Reset protocol to default(http)
 func TestReset(t *testing.T) {
 	assert := assert.New(t)
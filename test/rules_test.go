@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vkuznet/transfer2go/core"
+)
+
+// Map LFNs to PFNs with rules of agent TFC
+func TestPfnRules(t *testing.T) {
+	assert := assert.New(t)
+
+	rules := core.PfnRules{
+		{Protocol: "http", PathMatch: "^/store/(.*)", Result: "data/$1"},
+		{Protocol: "http", PathMatch: "^/abs/(.*)", Result: "/backend/abs/$1"},
+		{Protocol: "http", PathMatch: "^/up/(.*)", Result: "../$1"},
+		{Protocol: "http", PathMatch: "^/other/(.*)", Result: "/elsewhere/$1"},
+		{Protocol: "xrootd", PathMatch: "^/store/(.*)", Result: "root://host//store/$1"},
+		{Protocol: "posix", PathMatch: "^data/(.*)", Result: "posix/$1", Chain: "http"},
+	}
+	assert.NoError(rules.Validate())
+
+	var tests = []struct {
+		description string
+		protocol    string
+		lfn         string
+		expected    string
+		fails       bool
+	}{
+		{"Relative result", "http", "/store/a/file.root", "/backend/data/a/file.root", false},
+		{"Absolute result within backend", "http", "/abs/file.root", "/backend/abs/file.root", false},
+		{"Relative result outside of backend", "http", "/up/file.root", "", true},
+		{"Relative result escaping by LFN", "http", "/store/../../file.root", "", true},
+		{"Absolute result outside of backend", "http", "/other/file.root", "", true},
+		{"URL result", "xrootd", "/store/file.root", "root://host//store/file.root", false},
+		{"Chained rules", "posix", "/store/file.root", "/backend/posix/file.root", false},
+		{"No matching rule", "http", "/data/file.root", "/backend/data/file.root", false},
+		{"No matching rule with parent references", "http", "/data/../../file.root", "/backend/file.root", false},
+	}
+	for _, test := range tests {
+		pfn, err := core.BackendPfn(rules, test.protocol, test.lfn, "/backend")
+		if test.fails {
+			assert.Error(err, test.description)
+			continue
+		}
+		assert.NoError(err, test.description)
+		assert.Equal(test.expected, pfn, test.description)
+	}
+}
+
+// Validate rules which chain protocols in a loop
+func TestPfnRulesLoop(t *testing.T) {
+	assert := assert.New(t)
+
+	rules := core.PfnRules{
+		{Protocol: "http", PathMatch: "(.*)", Result: "$1", Chain: "posix"},
+		{Protocol: "posix", PathMatch: "(.*)", Result: "$1", Chain: "http"},
+	}
+	assert.Error(rules.Validate())
+	_, err := rules.LfnToPfn("http", "/store/file.root", "/backend")
+	assert.Error(err)
+
+	rules = core.PfnRules{{Protocol: "http", PathMatch: "(", Result: "$1"}}
+	assert.Error(rules.Validate())
+}
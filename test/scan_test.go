@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vkuznet/transfer2go/client"
+	"github.com/vkuznet/transfer2go/core"
+)
+
+// Derive catalog entries of files found in directory tree
+func TestScanRecords(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "transfer2go")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "run1")
+	for _, name := range []string{"a/f1.root", "a/f2.txt", "a/.hidden.root", "a/f4.root" + core.TempSuffix, ".meta/f3.root"} {
+		path := filepath.Join(root, name)
+		assert.NoError(os.MkdirAll(filepath.Dir(path), 0755))
+		assert.NoError(ioutil.WriteFile(path, []byte("some\n"), 0644))
+	}
+
+	var tests = []struct {
+		description string
+		rule        client.ScanRule
+		expected    []core.CatalogEntry
+	}{
+		{"Default rule", client.ScanRule{}, []core.CatalogEntry{
+			{Lfn: "/a/f1.root", Pfn: filepath.Join(root, "a/f1.root"), Dataset: "/run1", Block: "/run1#a"},
+			{Lfn: "/a/f2.txt", Pfn: filepath.Join(root, "a/f2.txt"), Dataset: "/run1", Block: "/run1#a"},
+		}},
+		{"Rule with pattern", client.ScanRule{Pattern: `^(?P<dir>\w+)/.*\.root$`, Dataset: "/{{.Root}}/{{.dir}}/raw", Lfn: "/store/{{.Base}}"}, []core.CatalogEntry{
+			{Lfn: "/store/f1.root", Pfn: filepath.Join(root, "a/f1.root"), Dataset: "/run1/a/raw", Block: "/run1/a/raw#a"},
+		}},
+	}
+	for _, test := range tests {
+		records, err := client.ScanRecords(root, test.rule)
+		assert.NoError(err, test.description)
+		assert.Equal(test.expected, records, test.description)
+	}
+
+	_, err = client.ScanRecords(root, client.ScanRule{Dataset: "/{{.run}}"})
+	assert.Error(err, "Unknown template key")
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vkuznet/transfer2go/core"
+	"github.com/vkuznet/transfer2go/utils"
+)
+
+// Create agent DB and apply interrupted migrations again
+func TestSchemaMigrations(t *testing.T) {
+	assert := assert.New(t)
+	defer initCatalog(t)()
+
+	files, err := filepath.Glob("../static/sql/sqlite3/migrate_*.sql")
+	assert.NoError(err)
+	version, err := core.SchemaVersion()
+	assert.NoError(err)
+	assert.Equal(len(files), version, "Schema version of new DB")
+
+	// changes of migrations which were not recorded are already in DB
+	_, err = core.DB.Exec("DELETE FROM SCHEMA_VERSION WHERE version>1")
+	assert.NoError(err)
+	assert.NoError(core.InitSchema(), "Apply migrations again")
+	version, err = core.SchemaVersion()
+	assert.NoError(err)
+	assert.Equal(len(files), version, "Schema version of migrated DB")
+}
+
+// Helper function to create agent DB in temporary sqlite file, it returns
+// function which removes the DB
+func initCatalog(t *testing.T) func() {
+	utils.STATICDIR = "../static"
+	dir, err := ioutil.TempDir("", "transfer2go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri := filepath.Join(dir, "catalog.db")
+	db, err := sql.Open("sqlite3", uri)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	core.DB = db
+	core.DBTYPE = "sqlite3"
+	core.DBSQL = core.LoadSQL("sqlite3", "")
+	core.TFC = core.Catalog{Type: "sqlite3", Uri: uri}
+	if err := core.InitSchema(); err != nil {
+		db.Close()
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
@@ -0,0 +1,150 @@
+package utils
+
+// transfer2go checksum algorithms
+// Copyright (c) 2017 - Valentin Kuznetsov <vkuznet@gmail.com>
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/adler32"
+	"hash/crc32"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Supported checksum algorithms
+const (
+	Adler32 = "adler32"
+	MD5     = "md5"
+	SHA256  = "sha256"
+	CRC32C  = "crc32c"
+)
+
+// DefaultChecksum is checksum algorithm used when none is specified
+const DefaultChecksum = Adler32
+
+var _crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// list of hasher constructors keyed by checksum algorithm
+var _hashers = map[string]func() hash.Hash{
+	Adler32: func() hash.Hash { return adler32.New() },
+	MD5:     md5.New,
+	SHA256:  sha256.New,
+	CRC32C:  func() hash.Hash { return crc32.New(_crc32c) },
+}
+
+// NewHasher returns hasher for given checksum algorithm
+func NewHasher(alg string) (hash.Hash, error) {
+	if alg == "" {
+		alg = DefaultChecksum
+	}
+	f, ok := _hashers[strings.ToLower(alg)]
+	if !ok {
+		return nil, fmt.Errorf("unsupported checksum algorithm %s", alg)
+	}
+	return f(), nil
+}
+
+// ChecksumAlgorithms returns sorted list of supported checksum algorithms
+func ChecksumAlgorithms() []string {
+	var out []string
+	for alg := range _hashers {
+		out = append(out, alg)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// ChecksumWriter computes checksums of all data written to it with multiple
+// algorithms at once
+type ChecksumWriter struct {
+	hashers map[string]hash.Hash
+	writer  io.Writer
+}
+
+// NewChecksumWriter returns ChecksumWriter for given checksum algorithms,
+// duplicate algorithms are computed once
+func NewChecksumWriter(algs ...string) (*ChecksumWriter, error) {
+	hashers := make(map[string]hash.Hash)
+	var writers []io.Writer
+	for _, alg := range algs {
+		alg = strings.ToLower(alg)
+		if alg == "" {
+			alg = DefaultChecksum
+		}
+		if _, ok := hashers[alg]; ok {
+			continue
+		}
+		h, err := NewHasher(alg)
+		if err != nil {
+			return nil, err
+		}
+		hashers[alg] = h
+		writers = append(writers, h)
+	}
+	return &ChecksumWriter{hashers: hashers, writer: io.MultiWriter(writers...)}, nil
+}
+
+// Write passes data to all hashers
+func (w *ChecksumWriter) Write(p []byte) (int, error) {
+	return w.writer.Write(p)
+}
+
+// Sums returns checksums of written data keyed by algorithm
+func (w *ChecksumWriter) Sums() map[string]string {
+	out := make(map[string]string)
+	for alg, h := range w.hashers {
+		out[alg] = hex.EncodeToString(h.Sum(nil))
+	}
+	return out
+}
+
+// Checksums computes checksums of data stream with given algorithms, it
+// returns checksums keyed by algorithm and number of bytes read from reader
+func Checksums(r io.Reader, algs ...string) (map[string]string, int64, error) {
+	w, err := NewChecksumWriter(algs...)
+	if err != nil {
+		return nil, 0, err
+	}
+	b, err := io.Copy(w, r)
+	if err != nil {
+		return nil, b, err
+	}
+	return w.Sums(), b, nil
+}
+
+// FormatChecksums returns string representation of checksums suitable for
+// HTTP headers, e.g. adler32:0a1b2c3d,sha256:...
+func FormatChecksums(sums map[string]string) string {
+	var out []string
+	for alg, sum := range sums {
+		out = append(out, fmt.Sprintf("%s:%s", alg, sum))
+	}
+	sort.Strings(out)
+	return strings.Join(out, ",")
+}
+
+// ParseChecksums parses checksums formatted by FormatChecksums
+func ParseChecksums(s string) (map[string]string, error) {
+	out := make(map[string]string)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		arr := strings.SplitN(item, ":", 2)
+		if len(arr) != 2 {
+			return out, fmt.Errorf("malformed checksum %s", item)
+		}
+		alg := strings.ToLower(arr[0])
+		if _, ok := _hashers[alg]; !ok {
+			return out, fmt.Errorf("unsupported checksum algorithm %s", arr[0])
+		}
+		out[alg] = arr[1]
+	}
+	return out, nil
+}
@@ -9,6 +9,7 @@ import (
 	"encoding/hex"
 	"fmt"
 	"hash/adler32"
+	"io"
 	"io/ioutil"
 	"net"
 	"os"
@@ -75,6 +76,17 @@ func Hash(data []byte) (string, int64) {
 	return hex.EncodeToString(hasher.Sum(nil)), int64(b)
 }
 
+// HashReader implements hash function for data stream, it returns a hash and
+// number of bytes read from given reader
+func HashReader(r io.Reader) (string, int64, error) {
+	hasher := adler32.New()
+	b, e := io.Copy(hasher, r)
+	if e != nil {
+		return "", b, e
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), b, nil
+}
+
 // Stack helper function to return Stack
 func Stack() string {
 	trace := make([]byte, 2048)